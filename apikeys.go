@@ -0,0 +1,326 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// localsAPIKey is the key of the *APIKey of an authenticated request in the locals of the request.
+const localsAPIKey = "apikey"
+
+// Scope is what an API key is allowed to do, every scope includes the ones before it.
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"  // read and list metrics, scrape /__metrics and list snapshots
+	ScopeWrite Scope = "write" // also create, update and describe metrics
+	ScopeAdmin Scope = "admin" // also delete metrics, export, import and restore snapshots
+)
+
+var scopeLevels = map[Scope]int{
+	ScopeRead:  1,
+	ScopeWrite: 2,
+	ScopeAdmin: 3,
+}
+
+func parseScope(s string) (Scope, bool) {
+	scope := Scope(strings.ToLower(s))
+	_, ok := scopeLevels[scope]
+	return scope, ok
+}
+
+// includes returns whether the scope allows everything the other scope allows.
+func (s Scope) includes(other Scope) bool {
+	return scopeLevels[s] >= scopeLevels[other]
+}
+
+// APIKey is a key clients authenticate with, given either as plaintext Key or as bcrypt Hash of it with
+// its ID, see HashAPIKey. Keys with prefixes can only access metrics whose key starts with one of them and
+// none of the endpoints that concern all metrics. Keys with a secret must sign their requests with it,
+// see WithSigning, the key alone is rejected.
+type APIKey struct {
+	Key      string
+	ID       string // of a hashed key, selects the hash to verify a presented key with
+	Hash     string
+	Secret   string
+	Scope    Scope
+	Prefixes []string
+	digest   [sha256.Size]byte // of the plaintext key, compared instead of the key so the time doesn't depend on it
+}
+
+// HashAPIKey returns the ID and the salted bcrypt hash of the key to be used as APIKey.ID and APIKey.Hash.
+// The key must have the form "<id>.<secret>", clients present all of it. The ID isn't secret, it selects
+// the hash a presented key is verified with, so bcrypt runs at most once per request.
+func HashAPIKey(key string) (string, string, error) {
+	id, ok := apiKeyID(key)
+	if !ok {
+		return "", "", errors.New("API key must have the form <id>.<secret>")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	return id, string(hash), err
+}
+
+// apiKeyID returns the ID of a key of the form "<id>.<secret>".
+func apiKeyID(key string) (string, bool) {
+	id, secret, ok := strings.Cut(key, ".")
+	return id, ok && id != "" && secret != ""
+}
+
+// matches returns whether the key is the one with the given digest. Hashed keys are verified
+// with bcrypt, plaintext keys with a constant-time comparison of their digests.
+func (k *APIKey) matches(key string, digest [sha256.Size]byte) bool {
+	if k.Hash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(k.Hash), []byte(key)) == nil
+	}
+	return subtle.ConstantTimeCompare(k.digest[:], digest[:]) == 1
+}
+
+// id identifies the key when it's replaced or removed.
+func (k *APIKey) id() string {
+	if k.Hash != "" {
+		return k.ID
+	}
+	return k.Key
+}
+
+// idempotencyScope separates the idempotency keys of the key from the ones of other keys.
+func (k *APIKey) idempotencyScope() string {
+	sum := sha256.Sum256([]byte(k.id()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// covers returns whether the key can access the metric with the given key, "" meaning all metrics.
+func (k *APIKey) covers(metric string) bool {
+	if len(k.Prefixes) == 0 {
+		return true
+	}
+	if metric == "" {
+		return false
+	}
+	metric = sanitizeKey(metric)
+	for _, prefix := range k.Prefixes {
+		if strings.HasPrefix(metric, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns an error if the key lacks the scope or can't access the metric, "" meaning all metrics.
+func (k *APIKey) allows(scope Scope, metric string) error {
+	if !k.Scope.includes(scope) {
+		return errScope
+	}
+	if !k.covers(metric) {
+		return errPrefix
+	}
+	return nil
+}
+
+// batchScope returns the scope needed for the batch item.
+func batchScope(item BatchItem) Scope {
+	if item.Op == BatchDelete {
+		return ScopeAdmin
+	}
+	return ScopeWrite
+}
+
+// authorize returns an error if the API key of the request lacks the scope or can't access the metric,
+// "" meaning all metrics.
+func authorize(c *fiber.Ctx, scope Scope, metric string) error {
+	k, ok := c.Locals(localsAPIKey).(*APIKey)
+	if !ok {
+		return errInvalid
+	}
+	return k.allows(scope, metric)
+}
+
+// newAPIKey validates the scope and hash and normalizes the prefixes of a key.
+func newAPIKey(key APIKey) (*APIKey, error) {
+	scope, ok := parseScope(string(key.Scope))
+	if !ok {
+		return nil, fmt.Errorf("unknown scope %q", key.Scope)
+	}
+	k := &APIKey{Key: key.Key, ID: key.ID, Hash: key.Hash, Secret: key.Secret, Scope: scope}
+	switch {
+	case k.Hash != "":
+		if _, err := bcrypt.Cost([]byte(k.Hash)); err != nil {
+			return nil, fmt.Errorf("invalid API key hash: %w", err)
+		}
+		if k.ID == "" || strings.Contains(k.ID, ".") {
+			return nil, fmt.Errorf("hashed API key without valid id %q", k.ID)
+		}
+		k.Key = ""
+	case k.Key == "":
+		return nil, fmt.Errorf("API key without key or hash")
+	default:
+		k.ID = ""
+		k.digest = sha256.Sum256([]byte(k.Key))
+	}
+	for _, prefix := range key.Prefixes {
+		k.Prefixes = append(k.Prefixes, sanitizeKey(prefix))
+	}
+	return k, nil
+}
+
+// keyCache remembers which hashed key a presented key matched by its digest, so bcrypt doesn't have to
+// run for every request. Failed verifications aren't remembered, so invalid keys can't fill the cache.
+// The keys lock must be held.
+type keyCache struct {
+	lock *sync.Mutex
+	keys map[[sha256.Size]byte]*APIKey
+}
+
+func (kc *keyCache) get(digest [sha256.Size]byte) (*APIKey, bool) {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+	k, ok := kc.keys[digest]
+	return k, ok
+}
+
+func (kc *keyCache) put(digest [sha256.Size]byte, k *APIKey) {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+	kc.keys[digest] = k
+}
+
+// reset forgets all verifications, the keys lock must be held for writing.
+func (kc *keyCache) reset() {
+	kc.lock.Lock()
+	defer kc.lock.Unlock()
+	kc.keys = map[[sha256.Size]byte]*APIKey{}
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{lock: &sync.Mutex{}, keys: map[[sha256.Size]byte]*APIKey{}}
+}
+
+// apiKey returns the key matching the given one or nil if there is none. Plaintext keys are all compared,
+// of the hashed keys only the one with the ID of the given key is verified.
+func (srv *Server) apiKey(key string) *APIKey {
+	digest := sha256.Sum256([]byte(key))
+	srv.keysLock.RLock()
+	defer srv.keysLock.RUnlock()
+	if k, ok := srv.keyCache.get(digest); ok {
+		return k
+	}
+	var match *APIKey
+	for _, k := range srv.apiKeys {
+		// no early return, so the time doesn't tell which key matched
+		if k.Hash == "" && k.matches(key, digest) && match == nil {
+			match = k
+		}
+	}
+	if id, ok := apiKeyID(key); ok && match == nil {
+		for _, k := range srv.apiKeys {
+			if k.Hash != "" && k.ID == id && k.matches(key, digest) {
+				srv.keyCache.put(digest, k)
+				return k
+			}
+		}
+	}
+	return match
+}
+
+// AddAPIKey adds a key that is allowed to do everything.
+func (srv *Server) AddAPIKey(key string) {
+	_ = srv.AddScopedAPIKey(key, ScopeAdmin)
+}
+
+// AddScopedAPIKey adds a key with the given scope. If prefixes are given, the key can only access metrics
+// whose key starts with one of them. Adding a key that already exists replaces its scope and prefixes.
+func (srv *Server) AddScopedAPIKey(key string, scope Scope, prefixes ...string) error {
+	return srv.addAPIKey(APIKey{Key: key, Scope: scope, Prefixes: prefixes})
+}
+
+// AddHashedAPIKey is AddScopedAPIKey with the ID and bcrypt hash of the key, see HashAPIKey.
+func (srv *Server) AddHashedAPIKey(id, hash string, scope Scope, prefixes ...string) error {
+	return srv.addAPIKey(APIKey{ID: id, Hash: hash, Scope: scope, Prefixes: prefixes})
+}
+
+// AddSigningAPIKey adds a key, given as Key or Hash, that must sign its requests with its Secret.
+// The key only identifies the client then and is rejected on its own.
+func (srv *Server) AddSigningAPIKey(key APIKey) error {
+	if key.Secret == "" {
+		return errors.New("signing API key without secret")
+	}
+	return srv.addAPIKey(key)
+}
+
+func (srv *Server) addAPIKey(key APIKey) error {
+	k, err := newAPIKey(key)
+	if err != nil {
+		return err
+	}
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	srv.keyCache.reset()
+	for i, existing := range srv.apiKeys {
+		if existing.id() == k.id() {
+			srv.apiKeys[i] = k
+			return nil
+		}
+	}
+	srv.apiKeys = append(srv.apiKeys, k)
+	return nil
+}
+
+// RemoveAPIKey revokes the plaintext key or the hashed key with the given ID, requests in flight are finished.
+// It returns whether the key existed.
+func (srv *Server) RemoveAPIKey(key string) bool {
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	srv.keyCache.reset()
+	for i, k := range srv.apiKeys {
+		if k.id() == key {
+			srv.apiKeys = append(srv.apiKeys[:i:i], srv.apiKeys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetAPIKeys replaces all keys at once, e.g. after the configuration was reloaded.
+// Nothing is changed if one of the keys is invalid.
+func (srv *Server) SetAPIKeys(keys []APIKey) error {
+	apiKeys, err := newAPIKeys(keys)
+	if err != nil {
+		return err
+	}
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	srv.setAPIKeys(apiKeys)
+	return nil
+}
+
+// newAPIKeys validates the keys and makes sure the IDs of the hashed keys are unique.
+func newAPIKeys(keys []APIKey) ([]*APIKey, error) {
+	apiKeys := make([]*APIKey, 0, len(keys))
+	ids := map[string]bool{}
+	for _, key := range keys {
+		k, err := newAPIKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.Hash != "" && ids[k.ID] {
+			return nil, fmt.Errorf("duplicate API key id %q", k.ID)
+		}
+		ids[k.ID] = true
+		apiKeys = append(apiKeys, k)
+	}
+	return apiKeys, nil
+}
+
+// setAPIKeys replaces the keys, the keys lock must be held for writing.
+func (srv *Server) setAPIKeys(apiKeys []*APIKey) {
+	srv.keyCache.reset()
+	srv.apiKeys = apiKeys
+}
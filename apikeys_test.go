@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// checkCode fails the test unless the error of the request carries the error code.
+func checkCode(t *testing.T, what string, err error, code int) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), strconv.Itoa(code)+":") {
+		t.Errorf("%s: expected error %d, got %v", what, code, err)
+	}
+}
+
+func TestScopeEnforcement(t *testing.T) {
+	_, port := startServer(t, nil,
+		APIKey{Key: "reader", Scope: ScopeRead},
+		APIKey{Key: "writer", Scope: ScopeWrite},
+	)
+	admin := NewClient("127.0.0.1", port, "key", true)
+	reader := NewClient("127.0.0.1", port, "reader", true)
+	writer := NewClient("127.0.0.1", port, "writer", true)
+	if err := admin.Create("g", "gauge", Gauge); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reader.Read("g"); err != nil {
+		t.Errorf("reader could not read: %v", err)
+	}
+	if _, err := reader.List(ListFilter{}); err != nil {
+		t.Errorf("reader could not list: %v", err)
+	}
+	checkCode(t, "reader create", reader.Create("r", "gauge", Gauge), errScope.Code)
+	checkCode(t, "reader update", reader.Update("g", 1), errScope.Code)
+	checkCode(t, "reader describe", reader.Describe("g", "changed"), errScope.Code)
+
+	if err := writer.Update("g", 2); err != nil {
+		t.Errorf("writer could not update: %v", err)
+	}
+	checkCode(t, "writer delete", writer.Delete("g"), errScope.Code)
+	_, err := writer.Export()
+	checkCode(t, "writer export", err, errScope.Code)
+	checkCode(t, "writer import", writer.Import(&State{}, ImportMerge), errScope.Code)
+
+	if v, err := admin.Read("g"); err != nil || v != 2 {
+		t.Errorf("g is %v (%v), expected 2", v, err)
+	}
+}
+
+func TestPrefixEnforcement(t *testing.T) {
+	_, port := startServer(t, nil, APIKey{Key: "app", Scope: ScopeAdmin, Prefixes: []string{"app_"}})
+	admin := NewClient("127.0.0.1", port, "key", true)
+	app := NewClient("127.0.0.1", port, "app", true)
+	for _, key := range []string{"app_a", "app_b", "other"} {
+		if err := admin.Create(key, "gauge", Gauge); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := app.Update("app_a", 1); err != nil {
+		t.Errorf("update of a covered metric failed: %v", err)
+	}
+	if err := app.Create("app_c", "gauge", Gauge); err != nil {
+		t.Errorf("create of a covered metric failed: %v", err)
+	}
+	_, err := app.Read("other")
+	checkCode(t, "read", err, errPrefix.Code)
+	checkCode(t, "update", app.Update("other", 1), errPrefix.Code)
+	checkCode(t, "create", app.Create("new", "gauge", Gauge), errPrefix.Code)
+	checkCode(t, "delete", app.Delete("other"), errPrefix.Code)
+
+	// endpoints covering all metrics are denied
+	_, err = app.Export()
+	checkCode(t, "export", err, errPrefix.Code)
+	checkCode(t, "import", app.Import(&State{}, ImportReplace), errPrefix.Code)
+	_, err = app.Snapshots()
+	checkCode(t, "snapshots", err, errPrefix.Code)
+
+	list, err := app.List(ListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, m := range list.Metrics {
+		keys = append(keys, m.Key)
+	}
+	if list.Total != 3 || strings.Join(keys, ",") != "app_a,app_b,app_c" {
+		t.Errorf("list of the prefixed key is %v (total %d), expected app_a,app_b,app_c", keys, list.Total)
+	}
+
+	if _, err := admin.Read("other"); err != nil {
+		t.Errorf("metric of another prefix was removed: %v", err)
+	}
+	if _, err := admin.Read("new"); err == nil {
+		t.Error("metric of another prefix was created")
+	}
+}
+
+func TestBatchItemAuthorization(t *testing.T) {
+	_, port := startServer(t, nil, APIKey{Key: "app", Scope: ScopeWrite, Prefixes: []string{"app_"}})
+	admin := NewClient("127.0.0.1", port, "key", true)
+	app := NewClient("127.0.0.1", port, "app", true)
+	for _, key := range []string{"app_a", "other"} {
+		if err := admin.Create(key, "gauge", Gauge); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := app.Batch().Increment("app_a").Increment("other").Delete("app_a").Increment("app_a").Commit()
+	if err == nil || len(results) != 4 {
+		t.Fatalf("expected the results of the batch with unauthorized items, got %+v, %v", results, err)
+	}
+	for i, code := range []int{0, errPrefix.Code, errScope.Code, 0} {
+		res := results[i]
+		if code == 0 && res.Status >= 400 || code != 0 && (res.Status != code/1000 || !strings.HasPrefix(res.Error, strconv.Itoa(code)+":")) {
+			t.Errorf("result %d is %d %q, expected error %d", i, res.Status, res.Error, code)
+		}
+	}
+	for key, want := range map[string]float64{"app_a": 2, "other": 0} {
+		if v, err := admin.Read(key); err != nil || v != want {
+			t.Errorf("%s is %v (%v), expected %v", key, v, err, want)
+		}
+	}
+
+	// an unauthorized item rolls back a transactional batch
+	if _, err := app.Batch().Transactional().Increment("app_a").Increment("other").Commit(); err == nil {
+		t.Error("transactional batch with an unauthorized item succeeded")
+	}
+	if v, err := admin.Read("app_a"); err != nil || v != 2 {
+		t.Errorf("app_a is %v (%v) after the rollback, expected 2", v, err)
+	}
+}
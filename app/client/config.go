@@ -9,9 +9,12 @@ import (
 )
 
 type Config struct {
-	Host   string `yaml:"host"`
-	Port   int    `yaml:"port"`
-	APIKey string `yaml:"key"`
+	Host    string `yaml:"host"`
+	Port    int    `yaml:"port"`
+	APIKey  string `yaml:"key"`
+	Secret  string `yaml:"secret"`
+	TLSKey  string `yaml:"tls_key"`
+	TLSCert string `yaml:"tls_cert"`
 }
 
 func LoadConfig(file string) (*Config, error) {
@@ -23,9 +26,12 @@ func LoadConfig(file string) (*Config, error) {
 		return nil, fmt.Errorf("file does not exist")
 	}
 	c := &Config{
-		Host:   "",
-		Port:   0,
-		APIKey: "",
+		Host:    "",
+		Port:    0,
+		APIKey:  "",
+		Secret:  "",
+		TLSKey:  "",
+		TLSCert: "",
 	}
 	b, err := os.ReadFile(file)
 	if err != nil {
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	metrics "github.com/toxyl/metric-nexus"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Printf("Usage:    %s [config file] [action] [key] <value>\n", os.Args[0])
+	if len(os.Args) < 4 && !(len(os.Args) == 3 && strings.ToUpper(os.Args[2]) == "LIST") {
+		fmt.Printf("Usage:    %s [config file] [action] [key] <value> <label=value ...>\n", os.Args[0])
 		fmt.Printf("Examples: %s config.yaml   CREATE   demo  'a demo key'\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   CREATE   demo  'a demo key' counter\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   CREATE   demo  'a demo key' counter host,app\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   INC      demo  host=h12 app=spider\n", os.Args[0])
 		fmt.Printf("          %s config.yaml   UPDATE   demo  123\n", os.Args[0])
 		fmt.Printf("          %s config.yaml   ADD      demo  123\n", os.Args[0])
 		fmt.Printf("          %s config.yaml   SUB      demo  123\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   OBSERVE  demo  0.25\n", os.Args[0])
 		fmt.Printf("          %s config.yaml   INC      demo\n", os.Args[0])
 		fmt.Printf("          %s config.yaml   DEC      demo\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   DESCRIBE demo  'a better description'\n", os.Args[0])
 		fmt.Printf("          %s config.yaml   READ     demo\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   LIST\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   LIST     spider_  regex=kills$ offset=0 limit=20\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   EXPORT   metrics.yaml\n", os.Args[0])
+		fmt.Printf("          %s config.yaml   IMPORT   metrics.yaml  merge|replace|skip\n", os.Args[0])
 		return
 	}
 	conf, err := LoadConfig(os.Args[1])
@@ -26,36 +40,125 @@ func main() {
 	}
 
 	action := strings.ToUpper(os.Args[2])
-	key := os.Args[3]
+	key := ""
+	rest := []string{}
+	if len(os.Args) > 3 {
+		key = os.Args[3]
+		rest = os.Args[4:]
+	}
+	args := []string{}
+	labels := metrics.Labels{}
+	for _, arg := range rest {
+		if n, v, ok := strings.Cut(arg, "="); ok && action != "CREATE" {
+			labels[n] = v
+			continue
+		}
+		args = append(args, arg)
+	}
 	val := ""
-	if action == "CREATE" || action == "UPDATE" || action == "ADD" || action == "SUB" {
-		if len(os.Args) != 5 {
+	typ := metrics.Gauge
+	labelNames := []string{}
+	if action == "CREATE" || action == "UPDATE" || action == "ADD" || action == "SUB" || action == "OBSERVE" || action == "DESCRIBE" {
+		if len(args) < 1 {
 			fmt.Printf("Action %s need a value!\n", action)
 			return
 		}
-		val = os.Args[4]
+		val = args[0]
+	}
+	if action == "CREATE" && len(args) >= 2 {
+		typ = metrics.MetricType(args[1])
+	}
+	if action == "CREATE" && len(args) >= 3 {
+		labelNames = strings.Split(args[2], ",")
 	}
 
-	client := metrics.NewClient(conf.Host, conf.Port, conf.APIKey, true)
+	opts := []metrics.ClientOption{}
+	if conf.TLSKey != "" && conf.TLSCert != "" {
+		opts = append(opts, metrics.WithClientCertificate(conf.TLSKey, conf.TLSCert))
+	}
+	if conf.Secret != "" {
+		opts = append(opts, metrics.WithSigning(conf.Secret))
+	}
+	client := metrics.NewClient(conf.Host, conf.Port, conf.APIKey, true, opts...)
 
 	switch action {
 	case "CREATE":
-		client.Create(key, val)
+		client.Create(key, val, typ, labelNames...)
 	case "UPDATE":
-		client.Update(key, val)
+		client.Update(key, val, labels)
 	case "ADD":
-		client.Add(key, val)
+		client.Add(key, val, labels)
 	case "SUB":
-		client.Subtract(key, val)
+		client.Subtract(key, val, labels)
+	case "OBSERVE":
+		client.Observe(key, val, labels)
 	case "INC":
-		client.Increment(key)
+		client.Increment(key, labels)
 	case "DEC":
-		client.Decrement(key)
+		client.Decrement(key, labels)
+	case "DESCRIBE":
+		client.Describe(key, val)
 	case "READ":
-		v, err := client.Read(key)
+		v, err := client.Read(key, labels)
 		if err != nil {
 			panic(err)
 		}
 		fmt.Println(v)
+	case "LIST":
+		filter := metrics.ListFilter{Prefix: key, Regex: labels["regex"]}
+		filter.Offset, _ = strconv.Atoi(labels["offset"])
+		filter.Limit, _ = strconv.Atoi(labels["limit"])
+		list, err := client.List(filter)
+		if err != nil {
+			panic(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tTYPE\tSERIES\tVALUE\tUPDATED\tDESCRIPTION")
+		for _, m := range list.Metrics {
+			value := "-"
+			if m.Value != nil {
+				value = fmt.Sprint(*m.Value)
+			}
+			updated := "-"
+			if !m.Updated.IsZero() {
+				updated = m.Updated.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", m.Key, m.Type, m.Series, value, updated, m.Description)
+		}
+		w.Flush()
+		fmt.Printf("%d of %d metrics (offset %d)\n", len(list.Metrics), list.Total, list.Offset)
+	case "EXPORT":
+		state, err := client.Export()
+		if err != nil {
+			panic(err)
+		}
+		var data []byte
+		if strings.HasSuffix(key, ".json") {
+			data, err = json.MarshalIndent(state, "", "  ")
+		} else {
+			data, err = yaml.Marshal(state)
+		}
+		if err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(key, data, 0644); err != nil {
+			panic(err)
+		}
+	case "IMPORT":
+		data, err := os.ReadFile(key)
+		if err != nil {
+			panic(err)
+		}
+		state, err := metrics.ParseState(data)
+		if err != nil {
+			panic(err)
+		}
+		mode := metrics.ImportMerge
+		if len(args) > 0 {
+			mode = metrics.ImportMode(args[0])
+		}
+		if err := client.Import(state, mode); err != nil {
+			panic(err)
+		}
 	}
 }
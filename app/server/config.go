@@ -5,17 +5,137 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	metrics "github.com/toxyl/metric-nexus"
 	"gopkg.in/yaml.v3"
 )
 
+type SnapshotConfig struct {
+	Hourly int `yaml:"hourly"`
+	Daily  int `yaml:"daily"`
+}
+
+// APIKeyConfig is an entry of the keys list. A plain string is a key that is allowed to do everything,
+// a mapping has the key or its id and bcrypt hash (see the hash-key command), the secret requests must be
+// signed with, its scope (read, write or admin) and the metric prefixes it's restricted to.
+type APIKeyConfig struct {
+	Key      string   `yaml:"key,omitempty"`
+	ID       string   `yaml:"id,omitempty"`
+	Hash     string   `yaml:"hash,omitempty"`
+	Secret   string   `yaml:"secret,omitempty"`
+	Scope    string   `yaml:"scope"`
+	Prefixes []string `yaml:"prefixes,omitempty"`
+}
+
+func (k *APIKeyConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		k.Scope = "admin"
+		return value.Decode(&k.Key)
+	}
+	type plain APIKeyConfig // without the methods, avoids the recursion
+	p := plain{Scope: "read"}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	if p.Key == "" && p.Hash == "" {
+		return fmt.Errorf("line %d: API key without key or hash", value.Line)
+	}
+	if p.Hash != "" && p.ID == "" {
+		return fmt.Errorf("line %d: hashed API key without id", value.Line)
+	}
+	*k = APIKeyConfig(p)
+	return nil
+}
+
+// ClientCertConfig is an entry of the client_certs list, mapping the common name or a subject
+// alternative name of a client certificate to its scope (read, write or admin) and metric prefixes.
+type ClientCertConfig struct {
+	Name     string   `yaml:"name"`
+	Scope    string   `yaml:"scope"`
+	Prefixes []string `yaml:"prefixes"`
+}
+
+func (cc *ClientCertConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain ClientCertConfig // without the methods, avoids the recursion
+	p := plain{Scope: "read"}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	if p.Name == "" {
+		return fmt.Errorf("line %d: client certificate without name", value.Line)
+	}
+	*cc = ClientCertConfig(p)
+	return nil
+}
+
 type Config struct {
-	Host      string   `yaml:"host"`
-	Port      int      `yaml:"port"`
-	StateFile string   `yaml:"state"`
-	CertFile  string   `yaml:"cert"`
-	KeyFile   string   `yaml:"key"`
-	APIKeys   []string `yaml:"keys"`
+	Host             string             `yaml:"host"`
+	Port             int                `yaml:"port"`
+	StateFile        string             `yaml:"state"`
+	StateBackend     string             `yaml:"backend"`
+	CertFile         string             `yaml:"cert"`
+	KeyFile          string             `yaml:"key"`
+	RuntimeMetrics   bool               `yaml:"runtime_metrics"`
+	RecoverState     bool               `yaml:"recover_state"`
+	Snapshots        SnapshotConfig     `yaml:"snapshots"`
+	FlushInterval    time.Duration      `yaml:"flush_interval"`
+	Durability       string             `yaml:"durability"`
+	BatchInterval    time.Duration      `yaml:"batch_interval"`
+	IdempotencyTTL   time.Duration      `yaml:"idempotency_ttl"`
+	SignatureWindow  time.Duration      `yaml:"signature_window"`
+	APIKeys          []APIKeyConfig     `yaml:"keys"`
+	ClientCA         string             `yaml:"client_ca"`
+	ClientCARequired bool               `yaml:"client_ca_required"`
+	ClientCerts      []ClientCertConfig `yaml:"client_certs"`
+}
+
+// apiKeys returns the keys of the config for the server.
+func (c *Config) apiKeys() []metrics.APIKey {
+	keys := make([]metrics.APIKey, 0, len(c.APIKeys))
+	for _, k := range c.APIKeys {
+		keys = append(keys, metrics.APIKey{Key: k.Key, ID: k.ID, Hash: k.Hash, Secret: k.Secret, Scope: metrics.Scope(k.Scope), Prefixes: k.Prefixes})
+	}
+	return keys
+}
+
+// clientCerts returns the client certificates of the config for the server.
+func (c *Config) clientCerts() []metrics.ClientCertificate {
+	certs := make([]metrics.ClientCertificate, 0, len(c.ClientCerts))
+	for _, cc := range c.ClientCerts {
+		certs = append(certs, metrics.ClientCertificate{Name: cc.Name, Scope: metrics.Scope(cc.Scope), Prefixes: cc.Prefixes})
+	}
+	return certs
+}
+
+// plaintextKeys returns the number of keys that are not stored as hash.
+func (c *Config) plaintextKeys() int {
+	n := 0
+	for _, k := range c.APIKeys {
+		if k.Hash == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// warnPlaintextKeys reports keys that should be replaced by their hashes.
+func (c *Config) warnPlaintextKeys() {
+	if n := c.plaintextKeys(); n > 0 {
+		fmt.Printf("Warning: %d API key(s) are stored in plaintext, replace them with the output of the hash-key command\n", n)
+	}
+}
+
+// files returns the config file and the TLS and client CA files it refers to, which are watched for changes.
+func (c *Config) files(file string) []string {
+	files := []string{file}
+	if c.KeyFile != "" && c.CertFile != "" {
+		files = append(files, c.KeyFile, c.CertFile)
+	}
+	if c.ClientCA != "" {
+		files = append(files, c.ClientCA)
+	}
+	return files
 }
 
 func LoadConfig(file string) (*Config, error) {
@@ -27,12 +147,24 @@ func LoadConfig(file string) (*Config, error) {
 		return nil, fmt.Errorf("file does not exist")
 	}
 	c := &Config{
-		Host:      "",
-		Port:      0,
-		StateFile: "",
-		CertFile:  "",
-		KeyFile:   "",
-		APIKeys:   []string{},
+		Host:             "",
+		Port:             0,
+		StateFile:        "",
+		StateBackend:     "yaml",
+		CertFile:         "",
+		KeyFile:          "",
+		RuntimeMetrics:   false,
+		RecoverState:     false,
+		Snapshots:        SnapshotConfig{Hourly: 24, Daily: 7},
+		FlushInterval:    time.Minute,
+		Durability:       "on-write",
+		BatchInterval:    10 * time.Millisecond,
+		IdempotencyTTL:   24 * time.Hour,
+		SignatureWindow:  5 * time.Minute,
+		APIKeys:          []APIKeyConfig{},
+		ClientCA:         "",
+		ClientCARequired: false,
+		ClientCerts:      []ClientCertConfig{},
 	}
 	b, err := os.ReadFile(file)
 	if err != nil {
@@ -44,7 +176,14 @@ func LoadConfig(file string) (*Config, error) {
 	}
 
 	if c.StateFile == "" {
-		c.StateFile = strings.TrimSuffix(strings.TrimSuffix(file, ".yaml"), ".yml") + ".state.yaml"
+		ext := ".yaml"
+		switch c.StateBackend {
+		case "jsonl":
+			ext = ".jsonl"
+		case "bolt":
+			ext = ".db"
+		}
+		c.StateFile = strings.TrimSuffix(strings.TrimSuffix(file, ".yaml"), ".yml") + ".state" + ext
 	}
 	return c, nil
 }
@@ -1,16 +1,51 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	metrics "github.com/toxyl/metric-nexus"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == "migrate" {
+		migrate(os.Args[2])
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "hash-key" {
+		hashKey(os.Args[2:])
+		return
+	}
+	if len(os.Args) == 3 && os.Args[1] == "gen-ca" {
+		generateCA(os.Args[2])
+		return
+	}
+	if len(os.Args) == 4 && os.Args[1] == "gen-client-cert" {
+		generateClientCertificate(os.Args[2], os.Args[3])
+		return
+	}
 	if len(os.Args) != 2 {
 		fmt.Printf("Usage:   %s [config file]\n", os.Args[0])
+		fmt.Printf("         %s migrate [state file]\n", os.Args[0])
+		fmt.Printf("         %s hash-key [scope] [prefix...]\n", os.Args[0])
+		fmt.Printf("         %s gen-ca [dir]\n", os.Args[0])
+		fmt.Printf("         %s gen-client-cert [dir] [name]\n", os.Args[0])
 		fmt.Printf("Example: %s config.yaml\n", os.Args[0])
+		fmt.Printf("         %s migrate config.state.yaml\n", os.Args[0])
+		fmt.Printf("         echo -n UnsafeKeyNumber2 | %s hash-key write spider_\n", os.Args[0])
+		fmt.Printf("         %s gen-ca ca\n", os.Args[0])
+		fmt.Printf("         %s gen-client-cert ca spider\n", os.Args[0])
 		return
 	}
 	conf, err := LoadConfig(os.Args[1])
@@ -18,9 +53,137 @@ func main() {
 		panic(err)
 	}
 
-	server := metrics.NewServer(conf.Host, conf.Port, conf.StateFile)
-	for _, k := range conf.APIKeys {
-		server.AddAPIKey(k)
+	opts := []metrics.ServerOption{
+		metrics.WithSnapshots(conf.Snapshots.Hourly, conf.Snapshots.Daily),
+		metrics.WithFlushInterval(conf.FlushInterval),
+		metrics.WithDurability(metrics.Durability(conf.Durability), conf.BatchInterval),
+		metrics.WithStateBackend(metrics.StateBackend(conf.StateBackend)),
+		metrics.WithIdempotencyTTL(conf.IdempotencyTTL),
+		metrics.WithSignatureWindow(conf.SignatureWindow),
+	}
+	if conf.RuntimeMetrics {
+		opts = append(opts, metrics.WithRuntimeMetrics())
+	}
+	if conf.RecoverState {
+		opts = append(opts, metrics.WithStateRecovery())
+	}
+	if conf.ClientCA != "" {
+		opts = append(opts, metrics.WithClientCA(conf.ClientCA, conf.ClientCARequired))
+	}
+	server := metrics.NewServer(conf.Host, conf.Port, conf.StateFile, opts...)
+	if err := server.SetAPIKeys(conf.apiKeys()); err != nil {
+		panic(err)
+	}
+	if err := server.SetClientCertificates(conf.clientCerts()); err != nil {
+		panic(err)
+	}
+	conf.warnPlaintextKeys()
+
+	stopped := make(chan struct{})
+	go watchConfig(server, os.Args[1], conf, stopped)
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Printf("Shutdown failed: %s\n", err.Error())
+		}
+	}()
+
+	if err := server.Start(conf.KeyFile, conf.CertFile); err != nil {
+		panic(err)
+	}
+	<-stopped
+}
+
+// migrate upgrades the state file to the current format and reports the changes.
+func migrate(file string) {
+	changes, err := metrics.MigrateStateFile(file)
+	if err != nil {
+		fmt.Printf("Migration failed: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%s is up to date\n", file)
+		return
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+}
+
+// hashKey reads a key from stdin and prints the config entry with its hash, the given scope (default admin)
+// and prefixes.
+func hashKey(args []string) {
+	scope := "admin"
+	if len(args) > 0 {
+		scope, args = strings.ToLower(args[0]), args[1:]
+	}
+	if scope != "read" && scope != "write" && scope != "admin" {
+		fmt.Fprintf(os.Stderr, "Unknown scope %q, use read, write or admin\n", scope)
+		os.Exit(1)
+	}
+	fmt.Fprint(os.Stderr, "Key: ")
+	key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "Reading the key failed: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr)
+	key = strings.TrimRight(key, "\r\n")
+	if key == "" {
+		fmt.Fprintln(os.Stderr, "The key must not be empty")
+		os.Exit(1)
+	}
+	if id, secret, ok := strings.Cut(key, "."); !ok || id == "" || secret == "" {
+		// the id selects the hash to verify with, it's prefixed to keys that don't have one
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		id = hex.EncodeToString(b)
+		key = id + "." + key
+		fmt.Fprintf(os.Stderr, "Clients authenticate with %s.<key>\n", id)
+	}
+	id, hash, err := metrics.HashAPIKey(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Hashing the key failed: %s\n", err.Error())
+		os.Exit(1)
+	}
+	out, err := yaml.Marshal([]APIKeyConfig{{ID: id, Hash: hash, Scope: scope, Prefixes: args}})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(string(out))
+}
+
+// generateCA creates the key and certificate of a local CA (ca.key and ca.cert) in the directory.
+func generateCA(dir string) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fmt.Printf("Creating the CA failed: %s\n", err.Error())
+		os.Exit(1)
+	}
+	keyFile, certFile := filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.cert")
+	if err := metrics.GenerateCA("metric-nexus local CA", keyFile, certFile); err != nil {
+		fmt.Printf("Creating the CA failed: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Created %s and %s, set client_ca to %s\n", keyFile, certFile, certFile)
+}
+
+// generateClientCertificate creates the key and certificate of a client (<name>.key and <name>.cert),
+// signed by the CA in the directory and valid for one year.
+func generateClientCertificate(dir, name string) {
+	keyFile, certFile := filepath.Join(dir, name+".key"), filepath.Join(dir, name+".cert")
+	err := metrics.GenerateClientCertificate(
+		filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.cert"), name, 365*24*time.Hour, keyFile, certFile,
+	)
+	if err != nil {
+		fmt.Printf("Creating the client certificate failed: %s\n", err.Error())
+		os.Exit(1)
 	}
-	panic(server.Start(conf.KeyFile, conf.CertFile))
+	fmt.Printf("Created %s and %s, add the name %q to client_certs\n", keyFile, certFile, name)
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	metrics "github.com/toxyl/metric-nexus"
+)
+
+// reloadCheckInterval is how often the config, TLS and client CA files are checked for changes.
+const reloadCheckInterval = 5 * time.Second
+
+// watchConfig re-reads the config on SIGHUP or when it, the TLS or the client CA files change on disk
+// and applies it to the running server until done is closed.
+func watchConfig(server *metrics.Server, file string, conf *Config, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	t := time.NewTicker(reloadCheckInterval)
+	defer t.Stop()
+	modified := modTimes(conf.files(file))
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+		case <-t.C:
+			current := modTimes(conf.files(file))
+			if current == modified {
+				continue
+			}
+		}
+		next, err := LoadConfig(file)
+		if err != nil {
+			fmt.Printf("Config reload failed, keeping the current config: %s\n", err.Error())
+			modified = modTimes(conf.files(file))
+			continue
+		}
+		if err := apply(server, conf, next); err != nil {
+			fmt.Printf("Config reload failed, keeping the current config: %s\n", err.Error())
+		} else {
+			conf = next
+			fmt.Println("Config reloaded")
+			conf.warnPlaintextKeys()
+		}
+		modified = modTimes(conf.files(file))
+	}
+}
+
+// apply changes the keys, client certificates, TLS certificate, client CA and limits of the server to the ones of the next config.
+// Other changes are reported as they need a restart.
+func apply(server *metrics.Server, conf, next *Config) error {
+	rc := metrics.RuntimeConfig{
+		APIKeys:         next.apiKeys(),
+		ClientCerts:     next.clientCerts(),
+		FlushInterval:   next.FlushInterval,
+		HourlySnapshots: next.Snapshots.Hourly,
+		DailySnapshots:  next.Snapshots.Daily,
+	}
+	if next.ClientCA != "" && conf.ClientCA != "" {
+		rc.ClientCAFile = next.ClientCA
+	}
+	if next.KeyFile != "" && next.CertFile != "" {
+		rc.KeyFile, rc.CertFile = next.KeyFile, next.CertFile
+	}
+	// all or nothing, a config that is invalid in one place doesn't replace the keys already
+	if err := server.Reload(rc); err != nil {
+		return err
+	}
+
+	for _, c := range []struct {
+		setting string
+		changed bool
+	}{
+		{"host", conf.Host != next.Host},
+		{"port", conf.Port != next.Port},
+		{"state", conf.StateFile != next.StateFile},
+		{"backend", conf.StateBackend != next.StateBackend},
+		{"runtime_metrics", conf.RuntimeMetrics != next.RuntimeMetrics},
+		{"recover_state", conf.RecoverState != next.RecoverState},
+		{"durability", conf.Durability != next.Durability},
+		{"batch_interval", conf.BatchInterval != next.BatchInterval},
+		{"idempotency_ttl", conf.IdempotencyTTL != next.IdempotencyTTL},
+		{"signature_window", conf.SignatureWindow != next.SignatureWindow},
+		{"client_ca", (conf.ClientCA == "") != (next.ClientCA == "")},
+		{"client_ca_required", conf.ClientCARequired != next.ClientCARequired},
+		{"key and cert", (next.KeyFile == "" || next.CertFile == "") && (conf.KeyFile != next.KeyFile || conf.CertFile != next.CertFile)},
+	} {
+		if c.changed {
+			fmt.Printf("Changed %s is applied after a restart\n", c.setting)
+		}
+	}
+	return nil
+}
+
+// modTimes returns the modification times of the files, concatenated for comparison.
+func modTimes(files []string) string {
+	res := ""
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			res += fi.ModTime().String()
+		}
+		res += "|"
+	}
+	return res
+}
@@ -0,0 +1,215 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxBatchItems limits the number of operations of a single batch.
+const maxBatchItems = 10000
+
+// BatchOp is the operation of a batch item.
+type BatchOp string
+
+const (
+	BatchCreate  BatchOp = "create"
+	BatchSet     BatchOp = "set"
+	BatchAdd     BatchOp = "add"
+	BatchSub     BatchOp = "sub"
+	BatchInc     BatchOp = "inc"
+	BatchDec     BatchOp = "dec"
+	BatchDelete  BatchOp = "delete"
+	BatchObserve BatchOp = "observe"
+)
+
+// BatchItem is a single operation of a batch.
+type BatchItem struct {
+	Op          BatchOp    `json:"op"`
+	Key         string     `json:"key"`
+	Labels      Labels     `json:"labels,omitempty"`      // labels of the series
+	Value       float64    `json:"value,omitempty"`       // set, add, sub and observe
+	Description string     `json:"description,omitempty"` // create
+	Type        MetricType `json:"type,omitempty"`        // create
+	LabelNames  []string   `json:"label_names,omitempty"` // create
+	Buckets     []float64  `json:"buckets,omitempty"`     // create histogram
+	Objectives  string     `json:"objectives,omitempty"`  // create summary, e.g. "0.5:0.05,0.9:0.01"
+}
+
+func (bi BatchItem) MarshalJSON() ([]byte, error) {
+	type plain BatchItem // without the methods, avoids the recursion
+	return json.Marshal(struct {
+		plain
+		Value jsonFloat `json:"value,omitempty"`
+	}{plain: plain(bi), Value: jsonFloat(bi.Value)})
+}
+
+func (bi *BatchItem) UnmarshalJSON(data []byte) error {
+	type plain BatchItem
+	jbi := struct {
+		*plain
+		Value jsonFloat `json:"value,omitempty"`
+	}{plain: (*plain)(bi)}
+	if err := json.Unmarshal(data, &jbi); err != nil {
+		return err
+	}
+	bi.Value = float64(jbi.Value)
+	return nil
+}
+
+// BatchResult is the result of a batch item.
+type BatchResult struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`          // HTTP status the operation would have had as a single request
+	Error  string `json:"error,omitempty"` // error code and message
+}
+
+// apply applies the batch item, the caller must hold the lock.
+func (srv *Server) apply(item BatchItem) (int, error) {
+	switch item.Op {
+	case BatchCreate:
+		typ, ok := parseMetricType(string(item.Type))
+		if !ok {
+			return 0, errInvalidType
+		}
+		buckets := item.Buckets
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+		objectives, ok := parseObjectives(item.Objectives)
+		if !ok {
+			return 0, errInvalidObjectives
+		}
+		if len(objectives) == 0 {
+			objectives = defaultObjectives
+		}
+		created, err := srv.create(item.Key, item.Description, typ, item.LabelNames, buckets, objectives)
+		if err != nil {
+			return 0, err
+		}
+		if created {
+			return fiber.StatusCreated, nil
+		}
+		return fiber.StatusOK, nil
+	case BatchSet:
+		return fiber.StatusNoContent, srv.update(item.Key, item.Value, item.Labels)
+	case BatchAdd:
+		return fiber.StatusNoContent, srv.add(item.Key, item.Value, item.Labels)
+	case BatchSub:
+		return fiber.StatusNoContent, srv.add(item.Key, -item.Value, item.Labels)
+	case BatchInc:
+		return fiber.StatusNoContent, srv.add(item.Key, 1, item.Labels)
+	case BatchDec:
+		return fiber.StatusNoContent, srv.add(item.Key, -1, item.Labels)
+	case BatchDelete:
+		return fiber.StatusNoContent, srv.delete(item.Key, item.Labels)
+	case BatchObserve:
+		return fiber.StatusNoContent, srv.observe(item.Key, item.Value, item.Labels)
+	}
+	return 0, errInvalidBatchOp
+}
+
+// Batch applies the items in order while holding the lock, so no other change is interleaved.
+// Failed items don't stop the batch unless it's transactional, then all changes are rolled back
+// and errBatchAborted is returned. The changes of a transactional batch are persisted at once after all items succeeded.
+func (srv *Server) Batch(items []BatchItem, transactional bool) ([]BatchResult, error) {
+	return srv.batch(items, transactional, nil)
+}
+
+// batch is Batch with a function that is asked for every item whether it may be applied,
+// e.g. by the API key of the request. A refused item fails with the returned error.
+func (srv *Server) batch(items []BatchItem, transactional bool, authorize func(item BatchItem) error) ([]BatchResult, error) {
+	if len(items) > maxBatchItems {
+		return nil, errInvalidBatch
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	// the changes of a transactional batch are only persisted once all items succeeded,
+	// the server lock keeps other changes out of the transaction
+	if transactional {
+		srv.state.begin()
+	}
+	// the metrics touched by a transactional batch, nil if they didn't exist
+	before := map[string]*StateMetric{}
+	results := make([]BatchResult, len(items))
+	for i, item := range items {
+		key := sanitizeKey(item.Key)
+		if _, ok := before[key]; !ok && transactional {
+			before[key] = nil
+			if _, ok := srv.data[key]; ok {
+				if sm, ok := srv.state.get(key); ok {
+					before[key] = &sm
+				}
+			}
+		}
+		var status int
+		var err error
+		if authorize != nil {
+			err = authorize(item)
+		}
+		if err == nil {
+			status, err = srv.apply(item)
+		}
+		results[i] = BatchResult{Key: key, Status: status}
+		if err == nil {
+			continue
+		}
+		results[i].Status, results[i].Error = errorStatus(err)
+		if !transactional {
+			continue
+		}
+		for j := range results {
+			if j != i {
+				results[j] = BatchResult{Key: sanitizeKey(items[j].Key)}
+				results[j].Status, results[j].Error = errorStatus(errBatchAborted)
+			}
+		}
+		err = srv.rollback(before)
+		srv.state.discard()
+		if err != nil {
+			return results, err
+		}
+		return results, errBatchAborted
+	}
+	if !transactional {
+		return results, nil
+	}
+	if err := srv.state.commit(); err != nil {
+		// nothing was persisted, the changes are undone in memory as well
+		srv.state.begin()
+		errRollback := srv.rollback(before)
+		srv.state.discard()
+		return nil, errors.Join(err, errRollback)
+	}
+	return results, nil
+}
+
+// rollback restores the given metrics and removes the ones that didn't exist (nil), the caller must hold the lock.
+func (srv *Server) rollback(before map[string]*StateMetric) error {
+	for key := range before {
+		delete(srv.data, key)
+	}
+	if err := srv.rebuildRegistry(); err != nil {
+		return err
+	}
+	errs := []error{}
+	for key, sm := range before {
+		if err := srv.state.Remove(key); err != nil {
+			errs = append(errs, err)
+		}
+		if sm == nil {
+			continue
+		}
+		if err := srv.restore(*sm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("batch could not be rolled back: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// failingBatch is a transactional batch whose last operation fails because the counter would decrease.
+var failingBatch = []BatchItem{
+	{Op: BatchCreate, Key: "n", Type: Gauge},
+	{Op: BatchAdd, Key: "c", Value: 2},
+	{Op: BatchSet, Key: "g", Value: 7},
+	{Op: BatchDelete, Key: "d"},
+	{Op: BatchSet, Key: "c", Value: 1},
+}
+
+// newBatchServer returns a server with the counter c at 5 and the gauges g and d at 0.
+func newBatchServer(t *testing.T, store StateStore) *Server {
+	t.Helper()
+	srv := newStoreServer(t, store)
+	for _, key := range []string{"g", "d"} {
+		if _, err := srv.Create(key, "gauge", Gauge); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := srv.Create("c", "counter", Counter); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Update("c", 5); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// checkUnchanged fails the test if the batch server differs from its initial state.
+func checkUnchanged(t *testing.T, srv *Server, state []StateMetric, exp string) {
+	t.Helper()
+	for key, want := range map[string]float64{"c": 5, "g": 0, "d": 0} {
+		if v, ok := srv.Read(key); !ok || v != want {
+			t.Errorf("%s is %v (%v) after the rollback, expected %v", key, v, ok, want)
+		}
+	}
+	if _, ok := srv.Read("n"); ok {
+		t.Error("metric created by the rolled back batch exists")
+	}
+	if after := srv.state.copyMetrics(); !sameMetrics(after, state) {
+		t.Errorf("state changed by the rolled back batch:\n%+v\n%+v", state, after)
+	}
+	if after := exposition(t, srv); after != exp {
+		t.Errorf("exposition changed by the rolled back batch:\n%s\n%s", exp, after)
+	}
+}
+
+func TestTransactionalBatchRollback(t *testing.T) {
+	store := newFailingStore()
+	srv := newBatchServer(t, store)
+	state, exp, applied := srv.state.copyMetrics(), exposition(t, srv), store.applied
+
+	results, err := srv.Batch(failingBatch, true)
+	if err != errBatchAborted {
+		t.Fatalf("expected the batch to be aborted, got %v", err)
+	}
+	for i, res := range results {
+		code := errBatchAborted.Code
+		if i == len(failingBatch)-1 {
+			code = errCounterDecrease.Code
+		}
+		if res.Status != code/1000 || !strings.HasPrefix(res.Error, strconv.Itoa(code)+":") {
+			t.Errorf("result %d is %d %q, expected error %d", i, res.Status, res.Error, code)
+		}
+	}
+	checkUnchanged(t, srv, state, exp)
+	if store.applied != applied {
+		t.Errorf("rolled back batch persisted %d changes", store.applied-applied)
+	}
+
+	// without the failing operation all changes are persisted as one batch mutation
+	if _, err := srv.Batch(failingBatch[:len(failingBatch)-1], true); err != nil {
+		t.Fatal(err)
+	}
+	if store.applied != applied+1 {
+		t.Errorf("transactional batch was persisted with %d mutations, expected 1", store.applied-applied)
+	}
+	if v, _ := srv.Read("c"); v != 7 {
+		t.Errorf("c is %v after the batch, expected 7", v)
+	}
+}
+
+func TestTransactionalBatchCommitFailure(t *testing.T) {
+	store := newFailingStore()
+	srv := newBatchServer(t, store)
+	state, exp := srv.state.copyMetrics(), exposition(t, srv)
+
+	store.setFail(true)
+	results, err := srv.Batch(failingBatch[:len(failingBatch)-1], true)
+	if results != nil || !errors.Is(err, errPersistence) {
+		t.Fatalf("expected the persistence error without results, got %v, %v", results, err)
+	}
+	checkUnchanged(t, srv, state, exp)
+}
+
+func TestTransactionalBatchResponse(t *testing.T) {
+	_, port := startServer(t, nil)
+	c := NewClient("127.0.0.1", port, "key", true)
+	if err := c.Create("c", "counter", Counter); err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.Batch().Transactional().Increment("c").Create("n", "gauge", Gauge).Decrement("c").Commit()
+	if err == nil {
+		t.Fatal("rolled back batch succeeded")
+	}
+	if len(results) != 3 || results[0].Status != fiber.StatusConflict || results[2].Status != errCounterDecrease.Code/1000 {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if v, err := c.Read("c"); err != nil || v != 0 {
+		t.Errorf("c is %v (%v) after the rollback, expected 0", v, err)
+	}
+}
+
+// TestTransactionalBatchCrash checks that a crash never persists part of a transactional batch,
+// neither one that was rolled back nor one that was interrupted before its commit.
+func TestTransactionalBatchCrash(t *testing.T) {
+	for _, backend := range []StateBackend{BackendYAML, BackendJSONLines, BackendBolt} {
+		t.Run(string(backend), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "state")
+			open := func() (StateStore, []StateMetric) {
+				store, err := newStateStore(backend, file, DurabilityOnWrite, time.Millisecond, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				metrics, err := store.Load()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store, metrics
+			}
+			store, _ := open()
+			srv := newBatchServer(t, store)
+			state := srv.state.copyMetrics()
+			if _, err := srv.Batch(failingBatch, true); err != errBatchAborted {
+				t.Fatalf("expected the batch to be aborted, got %v", err)
+			}
+			// the server crashes while a transactional batch is applied
+			srv.lock.Lock()
+			srv.state.begin()
+			for _, item := range failingBatch[:len(failingBatch)-1] {
+				if _, err := srv.apply(item); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			srv.lock.Unlock()
+
+			store, metrics := open()
+			defer store.Close()
+			if !sameMetrics(metrics, state) {
+				t.Errorf("state after the crash differs from the one before the batches:\n%+v\n%+v", state, metrics)
+			}
+		})
+	}
+}
+
+// sameMetrics compares the metrics regardless of their order and of how the times of their series were stored.
+func sameMetrics(a, b []StateMetric) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byKey := map[string]StateMetric{}
+	for _, m := range b {
+		byKey[m.Key] = m
+	}
+	for _, m := range a {
+		other, ok := byKey[m.Key]
+		if !ok || m.Type != other.Type || m.Description != other.Description || len(m.Series) != len(other.Series) {
+			return false
+		}
+		for i := range m.Series {
+			if m.Series[i].Value != other.Series[i].Value || !m.Series[i].Updated.Equal(other.Series[i].Updated) {
+				return false
+			}
+		}
+	}
+	return true
+}
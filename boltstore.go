@@ -0,0 +1,312 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltMetrics    = []byte("metrics")    // bucket with one bucket per metric
+	boltDefinition = []byte("definition") // key of the metric without its series
+	boltSeries     = []byte("series")     // bucket with the series of a metric
+)
+
+// boltStore keeps the state in a bbolt database, every metric has its own bucket
+// and every series its own key, so a change only rewrites the affected series.
+// Mutations are collected and committed in a single transaction per sync. As the database always
+// has all committed mutations, only the first save after loading rewrites it, e.g. with a recovered state.
+type boltStore struct {
+	file       string
+	durability Durability
+	interval   time.Duration
+	db         *bolt.DB
+	lock       *sync.Mutex // guards pending
+	commitLock *sync.Mutex // serializes commits and saves
+	pending    []Mutation
+	rewrite    bool // whether the next save replaces all metrics
+	syncer     *syncer
+}
+
+func boltEncode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func boltDecode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// boltSeriesKey prefixes the id of the series, bbolt doesn't allow empty keys.
+func boltSeriesKey(id string) []byte {
+	return []byte("s" + id)
+}
+
+// putMetric replaces the bucket of the metric.
+func putMetric(root *bolt.Bucket, m StateMetric) error {
+	if err := root.DeleteBucket([]byte(m.Key)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return err
+	}
+	b, err := root.CreateBucket([]byte(m.Key))
+	if err != nil {
+		return err
+	}
+	def := m
+	def.Series = nil
+	data, err := boltEncode(def)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(boltDefinition, data); err != nil {
+		return err
+	}
+	sb, err := b.CreateBucket(boltSeries)
+	if err != nil {
+		return err
+	}
+	for _, ss := range m.Series {
+		data, err := boltEncode(ss)
+		if err != nil {
+			return err
+		}
+		if err := sb.Put(boltSeriesKey(ss.id(m.Labels)), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBoltMutation applies the mutation to the metrics bucket.
+func applyBoltMutation(root *bolt.Bucket, mut Mutation) error {
+	switch mut.Op {
+	case MutationBatch:
+		for _, m := range mut.Mutations {
+			if err := applyBoltMutation(root, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	case MutationPut:
+		return putMetric(root, *mut.Metric)
+	case MutationRemove:
+		if err := root.DeleteBucket([]byte(mut.Key)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		return nil
+	}
+	b := root.Bucket([]byte(mut.Key))
+	if b == nil {
+		return nil
+	}
+	switch mut.Op {
+	case MutationDescribe:
+		def := StateMetric{}
+		if err := boltDecode(b.Get(boltDefinition), &def); err != nil {
+			return err
+		}
+		def.Description = mut.Description
+		data, err := boltEncode(def)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltDefinition, data)
+	case MutationPutSeries:
+		data, err := boltEncode(*mut.Series)
+		if err != nil {
+			return err
+		}
+		return b.Bucket(boltSeries).Put(boltSeriesKey(mut.Series.id(mut.Names)), data)
+	case MutationRemoveSeries:
+		return b.Bucket(boltSeries).Delete(boltSeriesKey(seriesID(mut.Values)))
+	}
+	return nil
+}
+
+// readBoltMetrics reads all metrics from the database.
+func readBoltMetrics(tx *bolt.Tx) ([]StateMetric, error) {
+	metrics := []StateMetric{}
+	root := tx.Bucket(boltMetrics)
+	if root == nil {
+		return metrics, nil
+	}
+	err := root.ForEach(func(k, _ []byte) error {
+		b := root.Bucket(k)
+		if b == nil {
+			return fmt.Errorf("metric %s is not a bucket", k)
+		}
+		m := StateMetric{}
+		if err := boltDecode(b.Get(boltDefinition), &m); err != nil {
+			return fmt.Errorf("metric %s: %w", k, err)
+		}
+		m.Series = []StateSeries{}
+		err := b.Bucket(boltSeries).ForEach(func(_, v []byte) error {
+			ss := StateSeries{}
+			if err := boltDecode(v, &ss); err != nil {
+				return fmt.Errorf("series of metric %s: %w", k, err)
+			}
+			m.Series = append(m.Series, ss)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m)
+		return nil
+	})
+	return metrics, err
+}
+
+func (bs *boltStore) open() error {
+	db, err := bolt.Open(bs.file, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltMetrics)
+		return err
+	}); err != nil {
+		return errors.Join(err, db.Close())
+	}
+	bs.db = db
+	bs.rewrite = true
+	bs.syncer = newSyncer(bs.durability, bs.interval, bs.flush)
+	return nil
+}
+
+// Load reads all metrics from the database. A database that can't be read is moved
+// to a timestamped .corrupt file and replaced by an empty one.
+func (bs *boltStore) Load() ([]StateMetric, error) {
+	err := bs.open()
+	if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+		corrupt := fmt.Sprintf("%s.%s.corrupt", bs.file, time.Now().Format("20060102-150405"))
+		if errMove := os.Rename(bs.file, corrupt); errMove != nil {
+			return nil, fmt.Errorf("state file %s is corrupt and could not be moved: %w", bs.file, errors.Join(err, errMove))
+		}
+		if errOpen := bs.open(); errOpen != nil {
+			return nil, errOpen
+		}
+		return nil, &CorruptStateError{File: bs.file, Copy: corrupt, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []StateMetric
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		metrics, err = readBoltMetrics(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// flush commits the pending mutations in a single transaction.
+func (bs *boltStore) flush() error {
+	bs.commitLock.Lock()
+	defer bs.commitLock.Unlock()
+	bs.lock.Lock()
+	muts := bs.pending
+	bs.pending = nil
+	bs.lock.Unlock()
+	if len(muts) == 0 {
+		return nil
+	}
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltMetrics)
+		for _, mut := range muts {
+			if err := applyBoltMutation(root, mut); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && bs.durability != DurabilityOnWrite {
+		// the mutations have been acknowledged already, retry them with the next commit
+		bs.lock.Lock()
+		bs.pending = append(muts, bs.pending...)
+		bs.lock.Unlock()
+	}
+	return err
+}
+
+// Save commits the pending mutations. After loading, it replaces all metrics of the database
+// in a single transaction instead, so they match the state the server continues with.
+func (bs *boltStore) Save(metrics []StateMetric) error {
+	if bs.db == nil {
+		return errors.New("state store is not loaded")
+	}
+	if !bs.rewrite {
+		return bs.syncer.sync()
+	}
+	bs.commitLock.Lock()
+	bs.lock.Lock()
+	bs.pending = nil
+	bs.lock.Unlock()
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltMetrics); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		root, err := tx.CreateBucket(boltMetrics)
+		if err != nil {
+			return err
+		}
+		for _, m := range metrics {
+			if err := putMetric(root, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	bs.commitLock.Unlock()
+	if err != nil {
+		return err
+	}
+	bs.rewrite = false
+	return bs.syncer.sync()
+}
+
+func (bs *boltStore) Apply(mut Mutation) error {
+	if bs.db == nil {
+		return errors.New("state store is not loaded")
+	}
+	bs.lock.Lock()
+	bs.pending = append(bs.pending, mut)
+	bs.lock.Unlock()
+	return bs.syncer.wrote()
+}
+
+func (bs *boltStore) Wait() {
+	if bs.syncer != nil {
+		bs.syncer.Wait()
+	}
+}
+
+func (bs *boltStore) Close() error {
+	if bs.db == nil {
+		return nil
+	}
+	err := errors.Join(bs.syncer.close(), bs.db.Close())
+	bs.db = nil
+	return err
+}
+
+func newBoltStore(file string, durability Durability, interval time.Duration) *boltStore {
+	return &boltStore{
+		file:       file,
+		durability: durability,
+		interval:   interval,
+		lock:       &sync.Mutex{},
+		commitLock: &sync.Mutex{},
+	}
+}
@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// bufferEntry holds the buffered changes of a series.
+type bufferEntry struct {
+	key    string
+	labels Labels
+	set    bool    // whether the series was updated
+	value  float64 // value of the last update
+	delta  float64 // sum of the increments and adds since the last update
+}
+
+// items returns the batch operations that apply the buffered changes.
+func (e *bufferEntry) items() []BatchItem {
+	items := []BatchItem{}
+	if e.set {
+		items = append(items, BatchItem{Op: BatchSet, Key: e.key, Labels: e.labels, Value: e.value})
+	}
+	if e.delta > 0 {
+		items = append(items, BatchItem{Op: BatchAdd, Key: e.key, Labels: e.labels, Value: e.delta})
+	} else if e.delta < 0 {
+		items = append(items, BatchItem{Op: BatchSub, Key: e.key, Labels: e.labels, Value: -e.delta})
+	}
+	return items
+}
+
+// buffer aggregates updates, increments and adds of a client until they are flushed with a batch.
+type buffer struct {
+	client    *Client
+	size      int
+	lock      *sync.Mutex
+	flushLock *sync.Mutex // keeps flushes in order
+	entries   map[string]*bufferEntry
+	order     []string // entry ids in the order of their first change
+	err       error    // error of the last background flush
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce *sync.Once
+}
+
+// change buffers a change of the series and flushes the buffer if it reached its size.
+// Keys are sanitized like the server does, so all changes of a series share an entry.
+func (b *buffer) change(ctx context.Context, key string, labels Labels, f func(e *bufferEntry)) error {
+	key = sanitizeKey(key)
+	id := key + "?" + labels.query().Encode()
+	b.lock.Lock()
+	e, ok := b.entries[id]
+	if !ok {
+		e = &bufferEntry{key: key, labels: labels}
+		b.entries[id] = e
+		b.order = append(b.order, id)
+	}
+	f(e)
+	full := len(b.entries) >= b.size
+	b.lock.Unlock()
+	if full {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+func (b *buffer) set(ctx context.Context, key string, v float64, labels Labels) error {
+	return b.change(ctx, key, labels, func(e *bufferEntry) {
+		e.set = true
+		e.value = v
+		e.delta = 0
+	})
+}
+
+func (b *buffer) add(ctx context.Context, key string, v float64, labels Labels) error {
+	return b.change(ctx, key, labels, func(e *bufferEntry) {
+		e.delta += v
+	})
+}
+
+// flush sends the buffered changes with a single batch.
+func (b *buffer) flush(ctx context.Context) error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+	b.lock.Lock()
+	entries, order := b.entries, b.order
+	b.entries, b.order = map[string]*bufferEntry{}, nil
+	b.lock.Unlock()
+	if len(order) == 0 {
+		return nil
+	}
+	items := []BatchItem{}
+	for _, id := range order {
+		items = append(items, entries[id].items()...)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	err := b.client.spooledBatch(ctx, items, func() error {
+		_, err := b.client.commit(ctx, items, false)
+		return err
+	})
+	var unavailable *unavailableError
+	if b.client.spool == nil && errors.As(err, &unavailable) {
+		// without a spool the changes are kept for the next flush
+		b.restore(entries, order)
+	}
+	return err
+}
+
+// restore merges the entries of a failed flush back into the buffer, before the changes buffered since.
+func (b *buffer) restore(entries map[string]*bufferEntry, order []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, id := range b.order {
+		e, old := b.entries[id], entries[id]
+		switch {
+		case old == nil:
+			entries[id] = e
+			order = append(order, id)
+		case e.set:
+			old.set, old.value, old.delta = true, e.value, e.delta
+		default:
+			old.delta += e.delta
+		}
+	}
+	b.entries, b.order = entries, order
+}
+
+// run flushes the buffer every interval until it's closed.
+func (b *buffer) run(interval time.Duration) {
+	defer close(b.stopped)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-t.C:
+			b.flushKeepError(context.Background())
+		}
+	}
+}
+
+// flushKeepError flushes the buffer and keeps the error for the next Flush or Close.
+func (b *buffer) flushKeepError(ctx context.Context) {
+	if err := b.flush(ctx); err != nil {
+		b.lock.Lock()
+		b.err = err
+		b.lock.Unlock()
+	}
+}
+
+// lastError returns and clears the error of the last flush that couldn't be returned.
+func (b *buffer) lastError() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// close stops the background flushes and flushes the remaining changes.
+func (b *buffer) close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		<-b.stopped
+	})
+	return b.flush(context.Background())
+}
+
+func newBuffer(c *Client, interval time.Duration, size int) *buffer {
+	b := &buffer{
+		client:    c,
+		size:      size,
+		lock:      &sync.Mutex{},
+		flushLock: &sync.Mutex{},
+		entries:   map[string]*bufferEntry{},
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go b.run(interval)
+	return b
+}
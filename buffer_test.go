@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBufferSanitizedKeys(t *testing.T) {
+	_, port := startServer(t, nil)
+	c := NewClient("127.0.0.1", port, "key", true, WithBuffer(time.Hour, 100))
+	defer c.Close()
+	if err := c.Create("foo_bar", "gauge", Gauge); err != nil {
+		t.Fatal(err)
+	}
+	// the update replaces the first add although it's sent with another spelling of the key
+	if err := c.Add("foo_bar", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Update("Foo-Bar", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("foo_bar", 3); err != nil {
+		t.Fatal(err)
+	}
+	c.buffer.lock.Lock()
+	n := len(c.buffer.entries)
+	c.buffer.lock.Unlock()
+	if n != 1 {
+		t.Errorf("changes of one series are buffered in %d entries", n)
+	}
+	if v, err := c.Read("foo_bar"); err != nil || v != 13 {
+		t.Errorf("foo_bar is %v (%v), expected 13", v, err)
+	}
+}
@@ -1,258 +1,829 @@
 package metrics
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 type Client struct {
 	addr            string
 	apiKey          string
+	secret          string // signs requests, see WithSigning
 	allowSelfSigned bool
+	certFile        string // client certificate, see WithClientCertificate
+	keyFile         string
+	tlsConfig       *tls.Config
+	bufferInterval  time.Duration
+	bufferSize      int
+	buffer          *buffer
+	spoolFile       string
+	spoolSize       int
+	spoolOverflow   SpoolOverflow
+	spool           *spool
+	timeout         time.Duration
+	retries         int
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
 }
 
-func (c *Client) Create(key, description string) error {
+// send performs a request against the given path and returns the status code and body of the response.
+// Requests are retried if the server is unavailable, see WithRetry. Changes carry an idempotency key that
+// is the same for all attempts, so the server applies them only once.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body string) (int, []byte, []error) {
+	key := ""
+	if method != fiber.MethodGet {
+		key = uuid.NewString()
+	}
+	return c.sendWithKey(ctx, method, path, query, body, key)
+}
+
+// sendWithKey is like send but with the given idempotency key, e.g. of a spooled batch.
+func (c *Client) sendWithKey(ctx context.Context, method, path string, query url.Values, body, key string) (int, []byte, []error) {
+	for attempt := 0; ; attempt++ {
+		code, resp, errs := c.sendOnce(ctx, method, path, query, body, key)
+		if attempt >= c.retries || !retryable(code, resp, errs) {
+			return code, resp, errs
+		}
+		t := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return code, resp, append(errs, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// retryable returns whether another attempt of a request that failed with the given response may succeed.
+// Changes the server could not persist aren't retried, the state store rarely recovers within the backoff.
+func retryable(code int, resp []byte, errs []error) bool {
+	if len(errs) > 0 {
+		return true
+	}
+	if code == fiber.StatusInternalServerError && bytes.HasPrefix(resp, []byte(strconv.Itoa(errPersistence.Code)+":")) {
+		return false
+	}
+	return code >= fiber.StatusInternalServerError || code == fiber.StatusTooManyRequests
+}
+
+// backoff returns a random delay of up to the minimum backoff doubled for each attempt, limited by the maximum backoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff
+	for i := 0; i < attempt && d < c.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// sendOnce performs a single attempt of the request, limited by the timeout of the client and the deadline of the context.
+func (c *Client) sendOnce(ctx context.Context, method, path string, query url.Values, body, idempotencyKey string) (int, []byte, []error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, []error{err}
+	}
+	timeout := c.timeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout <= 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return 0, nil, []error{context.DeadlineExceeded}
+		}
+	}
+
 	a := fiber.AcquireAgent()
 	req := a.Request()
-	req.Header.SetMethod(fiber.MethodPost)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s", c.addr, key))
-	req.SetBodyString(description)
+	req.Header.SetMethod(method)
+	if idempotencyKey != "" {
+		req.Header.Set(headerIdempotencyKey, idempotencyKey)
+	}
+	uri := fmt.Sprintf("%s/%s", c.addr, path)
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req.SetRequestURI(uri)
+	if body != "" {
+		req.SetBodyString(body)
+	}
+	if c.secret != "" {
+		// every attempt gets its own timestamp and nonce, so retries aren't taken for replays
+		timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), uuid.NewString()
+		req.Header.Set("authorization", "signature "+c.apiKey)
+		req.Header.Set(headerSignatureTimestamp, timestamp)
+		req.Header.Set(headerSignatureNonce, nonce)
+		req.Header.Set(headerSignature, signature(c.secret, method, string(req.URI().RequestURI()), timestamp, nonce, req.Body()))
+	} else {
+		req.Header.Set("authorization", "token "+c.apiKey)
+	}
 
 	if err := a.Parse(); err != nil {
-		return err
+		return 0, nil, []error{err}
 	}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+	a = a.TLSConfig(c.tlsConfig)
+	if timeout > 0 {
+		a = a.Timeout(timeout)
 	}
-	code, _, errs := a.Bytes()
+	return a.Bytes()
+}
 
-	if code != fiber.StatusCreated && code != fiber.StatusOK {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
-		}
-		return errors.New("failed to create metric")
+// Create creates the metric if it doesn't exist, histograms and summaries use the default buckets and objectives.
+// The optional label names define which labels every series of the metric must have.
+func (c *Client) Create(key, description string, typ MetricType, labels ...string) error {
+	return c.CreateCtx(context.Background(), key, description, typ, labels...)
+}
+
+// CreateCtx is like Create but the context limits the time of the request and its retries.
+func (c *Client) CreateCtx(ctx context.Context, key, description string, typ MetricType, labels ...string) error {
+	return c.create(ctx, BatchItem{Op: BatchCreate, Key: key, Description: description, Type: typ, LabelNames: labels})
+}
+
+func (c *Client) CreateHistogram(key, description string, buckets []float64, labels ...string) error {
+	return c.CreateHistogramCtx(context.Background(), key, description, buckets, labels...)
+}
+
+// CreateHistogramCtx is like CreateHistogram but the context limits the time of the request and its retries.
+func (c *Client) CreateHistogramCtx(ctx context.Context, key, description string, buckets []float64, labels ...string) error {
+	return c.create(ctx, BatchItem{Op: BatchCreate, Key: key, Description: description, Type: Histogram, Buckets: buckets, LabelNames: labels})
+}
+
+func (c *Client) CreateSummary(key, description string, objectives map[float64]float64, labels ...string) error {
+	return c.CreateSummaryCtx(context.Background(), key, description, objectives, labels...)
+}
+
+// CreateSummaryCtx is like CreateSummary but the context limits the time of the request and its retries.
+func (c *Client) CreateSummaryCtx(ctx context.Context, key, description string, objectives map[float64]float64, labels ...string) error {
+	return c.create(ctx, BatchItem{Op: BatchCreate, Key: key, Description: description, Type: Summary, Objectives: formatObjectives(objectives), LabelNames: labels})
+}
+
+func (c *Client) create(ctx context.Context, item BatchItem) error {
+	query := url.Values{"type": {string(item.Type)}}
+	switch item.Type {
+	case Histogram:
+		query.Set("buckets", formatBuckets(item.Buckets))
+	case Summary:
+		query.Set("objectives", item.Objectives)
 	}
+	if len(item.LabelNames) > 0 {
+		query.Set("labels", strings.Join(item.LabelNames, ","))
+	}
+	return c.spooled(ctx, item, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPost, item.Key, query, item.Description)
 
-	return nil
+		if code != fiber.StatusCreated && code != fiber.StatusOK {
+			return requestError(code, body, errs, "failed to create metric")
+		}
+
+		return nil
+	})
 }
 
-func (c *Client) Update(key string, value interface{}) error {
+func (c *Client) Update(key string, value interface{}, labels ...Labels) error {
+	return c.UpdateCtx(context.Background(), key, value, labels...)
+}
+
+// UpdateCtx is like Update but the context limits the time of the request and its retries.
+func (c *Client) UpdateCtx(ctx context.Context, key string, value interface{}, labels ...Labels) error {
 	v, ok := interfaceToFloat64(value)
 	if !ok {
 		return errors.New("could not parse value")
 	}
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodPut)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s", c.addr, key))
-	req.SetBodyString(fmt.Sprint(v))
-
-	if err := a.Parse(); err != nil {
-		return err
+	if c.buffer != nil {
+		return c.buffer.set(ctx, key, v, mergeLabels(labels...))
 	}
+	return c.spooled(ctx, BatchItem{Op: BatchSet, Key: key, Labels: mergeLabels(labels...), Value: v}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPut, key, mergeLabels(labels...).query(), fmt.Sprint(v))
+
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to update metric")
+		}
+
+		return nil
+	})
+}
+
+func (c *Client) Add(key string, value interface{}, labels ...Labels) error {
+	return c.AddCtx(context.Background(), key, value, labels...)
+}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+// AddCtx is like Add but the context limits the time of the request and its retries.
+func (c *Client) AddCtx(ctx context.Context, key string, value interface{}, labels ...Labels) error {
+	v, ok := interfaceToFloat64(value)
+	if !ok {
+		return errors.New("could not parse value")
 	}
-	code, _, errs := a.Bytes()
+	if c.buffer != nil {
+		return c.buffer.add(ctx, key, v, mergeLabels(labels...))
+	}
+	return c.spooled(ctx, BatchItem{Op: BatchAdd, Key: key, Labels: mergeLabels(labels...), Value: v}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPut, key+"/add", mergeLabels(labels...).query(), fmt.Sprint(v))
 
-	if code != fiber.StatusNoContent {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to update metric")
 		}
-		return errors.New("failed to update metric")
-	}
 
-	return nil
+		return nil
+	})
 }
 
-func (c *Client) Add(key string, value interface{}) error {
+func (c *Client) Subtract(key string, value interface{}, labels ...Labels) error {
+	return c.SubtractCtx(context.Background(), key, value, labels...)
+}
+
+// SubtractCtx is like Subtract but the context limits the time of the request and its retries.
+func (c *Client) SubtractCtx(ctx context.Context, key string, value interface{}, labels ...Labels) error {
 	v, ok := interfaceToFloat64(value)
 	if !ok {
 		return errors.New("could not parse value")
 	}
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodPut)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s/add", c.addr, key))
-	req.SetBodyString(fmt.Sprint(v))
+	if c.buffer != nil {
+		return c.buffer.add(ctx, key, -v, mergeLabels(labels...))
+	}
+	return c.spooled(ctx, BatchItem{Op: BatchSub, Key: key, Labels: mergeLabels(labels...), Value: v}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPut, key+"/sub", mergeLabels(labels...).query(), fmt.Sprint(v))
 
-	if err := a.Parse(); err != nil {
-		return err
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to update metric")
+		}
+
+		return nil
+	})
+}
+
+func (c *Client) Observe(key string, value interface{}, labels ...Labels) error {
+	return c.ObserveCtx(context.Background(), key, value, labels...)
+}
+
+// ObserveCtx is like Observe but the context limits the time of the request and its retries.
+func (c *Client) ObserveCtx(ctx context.Context, key string, value interface{}, labels ...Labels) error {
+	v, ok := interfaceToFloat64(value)
+	if !ok {
+		return errors.New("could not parse value")
 	}
+	return c.spooled(ctx, BatchItem{Op: BatchObserve, Key: key, Labels: mergeLabels(labels...), Value: v}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPut, key+"/observe", mergeLabels(labels...).query(), fmt.Sprint(v))
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to observe metric")
+		}
+
+		return nil
+	})
+}
+
+func (c *Client) Increment(key string, labels ...Labels) error {
+	return c.IncrementCtx(context.Background(), key, labels...)
+}
+
+// IncrementCtx is like Increment but the context limits the time of the request and its retries.
+func (c *Client) IncrementCtx(ctx context.Context, key string, labels ...Labels) error {
+	if c.buffer != nil {
+		return c.buffer.add(ctx, key, 1, mergeLabels(labels...))
 	}
-	code, _, errs := a.Bytes()
+	return c.spooled(ctx, BatchItem{Op: BatchInc, Key: key, Labels: mergeLabels(labels...)}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPut, key+"/inc", mergeLabels(labels...).query(), "")
 
-	if code != fiber.StatusNoContent {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to increment metric")
 		}
-		return errors.New("failed to update metric")
+
+		return nil
+	})
+}
+
+func (c *Client) Decrement(key string, labels ...Labels) error {
+	return c.DecrementCtx(context.Background(), key, labels...)
+}
+
+// DecrementCtx is like Decrement but the context limits the time of the request and its retries.
+func (c *Client) DecrementCtx(ctx context.Context, key string, labels ...Labels) error {
+	if c.buffer != nil {
+		return c.buffer.add(ctx, key, -1, mergeLabels(labels...))
 	}
+	return c.spooled(ctx, BatchItem{Op: BatchDec, Key: key, Labels: mergeLabels(labels...)}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodPut, key+"/dec", mergeLabels(labels...).query(), "")
 
-	return nil
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to decrement metric")
+		}
+
+		return nil
+	})
 }
 
-func (c *Client) Subtract(key string, value interface{}) error {
-	v, ok := interfaceToFloat64(value)
-	if !ok {
-		return errors.New("could not parse value")
+// CreateUpdate creates the metric if it doesn't exist and sets the series identified by the given labels.
+// The label names of the metric are taken from the given labels.
+func (c *Client) CreateUpdate(key, description string, typ MetricType, value interface{}, labels ...Labels) error {
+	return c.CreateUpdateCtx(context.Background(), key, description, typ, value, labels...)
+}
+
+// CreateUpdateCtx is like CreateUpdate but the context limits the time of the request and its retries.
+func (c *Client) CreateUpdateCtx(ctx context.Context, key, description string, typ MetricType, value interface{}, labels ...Labels) error {
+	l := mergeLabels(labels...)
+	_ = c.CreateCtx(ctx, key, description, typ, l.Names()...)
+	return c.UpdateCtx(ctx, key, value, l)
+}
+
+// Read returns the value of the series. Buffered changes are flushed first, errors of that flush are returned by the next Flush or Close.
+func (c *Client) Read(key string, labels ...Labels) (float64, error) {
+	return c.ReadCtx(context.Background(), key, labels...)
+}
+
+// ReadCtx is like Read but the context limits the time of the request and its retries.
+func (c *Client) ReadCtx(ctx context.Context, key string, labels ...Labels) (float64, error) {
+	if c.buffer != nil {
+		c.buffer.flushKeepError(ctx)
 	}
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodPut)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s/sub", c.addr, key))
-	req.SetBodyString(fmt.Sprint(v))
+	code, body, errs := c.send(ctx, fiber.MethodGet, key, mergeLabels(labels...).query(), "")
 
-	if err := a.Parse(); err != nil {
-		return err
+	if code != fiber.StatusOK {
+		return 0, requestError(code, body, errs, "failed to read metric")
 	}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+	if v, ok := interfaceToFloat64(body); ok {
+		return v, nil
 	}
-	code, _, errs := a.Bytes()
+
+	return 0, errors.New("failed to parse read metric")
+}
+
+// Describe changes the description of the metric without losing its values.
+func (c *Client) Describe(key, description string) error {
+	return c.DescribeCtx(context.Background(), key, description)
+}
+
+// DescribeCtx is like Describe but the context limits the time of the request and its retries.
+func (c *Client) DescribeCtx(ctx context.Context, key, description string) error {
+	code, body, errs := c.send(ctx, fiber.MethodPatch, key, nil, description)
 
 	if code != fiber.StatusNoContent {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
-		}
-		return errors.New("failed to update metric")
+		return requestError(code, body, errs, "failed to describe metric")
 	}
 
 	return nil
 }
 
-func (c *Client) Increment(key string) error {
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodPut)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s/inc", c.addr, key))
+// Delete removes the metric or, if labels are given, only the series identified by them.
+// Buffered changes are flushed first, errors of that flush are returned by the next Flush or Close.
+func (c *Client) Delete(key string, labels ...Labels) error {
+	return c.DeleteCtx(context.Background(), key, labels...)
+}
 
-	if err := a.Parse(); err != nil {
-		return err
+// DeleteCtx is like Delete but the context limits the time of the request and its retries.
+func (c *Client) DeleteCtx(ctx context.Context, key string, labels ...Labels) error {
+	if c.buffer != nil {
+		c.buffer.flushKeepError(ctx)
+	}
+	return c.spooled(ctx, BatchItem{Op: BatchDelete, Key: key, Labels: mergeLabels(labels...)}, func() error {
+		code, body, errs := c.send(ctx, fiber.MethodDelete, key, mergeLabels(labels...).query(), "")
+
+		if code != fiber.StatusNoContent {
+			return requestError(code, body, errs, "failed to delete metric")
+		}
+
+		return nil
+	})
+}
+
+// Snapshots returns the rotated snapshots of the server state, newest first.
+func (c *Client) Snapshots() ([]Snapshot, error) {
+	return c.SnapshotsCtx(context.Background())
+}
+
+// SnapshotsCtx is like Snapshots but the context limits the time of the request and its retries.
+func (c *Client) SnapshotsCtx(ctx context.Context) ([]Snapshot, error) {
+	code, body, errs := c.send(ctx, fiber.MethodGet, "__snapshots", nil, "")
+
+	if code != fiber.StatusOK {
+		return nil, requestError(code, body, errs, "failed to list snapshots")
 	}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+	snapshots := []Snapshot{}
+	if err := json.Unmarshal(body, &snapshots); err != nil {
+		return nil, errors.New("failed to parse snapshots")
 	}
-	code, _, errs := a.Bytes()
+
+	return snapshots, nil
+}
+
+// RestoreSnapshot replaces all metrics of the server with the ones of the given snapshot.
+func (c *Client) RestoreSnapshot(name string) error {
+	return c.RestoreSnapshotCtx(context.Background(), name)
+}
+
+// RestoreSnapshotCtx is like RestoreSnapshot but the context limits the time of the request and its retries.
+func (c *Client) RestoreSnapshotCtx(ctx context.Context, name string) error {
+	code, body, errs := c.send(ctx, fiber.MethodPost, "__snapshots/"+url.PathEscape(name)+"/restore", nil, "")
 
 	if code != fiber.StatusNoContent {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
-		}
-		return errors.New("failed to increment metric")
+		return requestError(code, body, errs, "failed to restore snapshot")
 	}
 
 	return nil
 }
 
-func (c *Client) Decrement(key string) error {
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodPut)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s/dec", c.addr, key))
+// List returns the metrics matching the filter, sorted by key.
+func (c *Client) List(filter ListFilter) (*MetricList, error) {
+	return c.ListCtx(context.Background(), filter)
+}
 
-	if err := a.Parse(); err != nil {
-		return err
+// ListCtx is like List but the context limits the time of the request and its retries.
+func (c *Client) ListCtx(ctx context.Context, filter ListFilter) (*MetricList, error) {
+	query := url.Values{}
+	if filter.Prefix != "" {
+		query.Set("prefix", filter.Prefix)
+	}
+	if filter.Regex != "" {
+		query.Set("regex", filter.Regex)
+	}
+	if filter.Offset != 0 {
+		query.Set("offset", fmt.Sprint(filter.Offset))
+	}
+	if filter.Limit != 0 {
+		query.Set("limit", fmt.Sprint(filter.Limit))
+	}
+	code, body, errs := c.send(ctx, fiber.MethodGet, "__list", query, "")
+
+	if code != fiber.StatusOK {
+		return nil, requestError(code, body, errs, "failed to list metrics")
+	}
+
+	list := &MetricList{}
+	if err := json.Unmarshal(body, list); err != nil {
+		return nil, errors.New("failed to parse metric list")
+	}
+
+	return list, nil
+}
+
+// Export returns all metrics of the server with their series.
+func (c *Client) Export() (*State, error) {
+	return c.ExportCtx(context.Background())
+}
+
+// ExportCtx is like Export but the context limits the time of the request and its retries.
+func (c *Client) ExportCtx(ctx context.Context) (*State, error) {
+	code, body, errs := c.send(ctx, fiber.MethodGet, "__export", nil, "")
+
+	if code != fiber.StatusOK {
+		return nil, requestError(code, body, errs, "failed to export metrics")
 	}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+	state := &State{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, errors.New("failed to parse exported metrics")
 	}
-	code, _, errs := a.Bytes()
+
+	return state, nil
+}
+
+// Import adds the metrics of the state to the server, see ImportMode for how they are combined with existing ones.
+func (c *Client) Import(state *State, mode ImportMode) error {
+	return c.ImportCtx(context.Background(), state, mode)
+}
+
+// ImportCtx is like Import but the context limits the time of the request and its retries.
+func (c *Client) ImportCtx(ctx context.Context, state *State, mode ImportMode) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	code, body, errs := c.send(ctx, fiber.MethodPost, "__import", url.Values{"mode": {string(mode)}}, string(data))
 
 	if code != fiber.StatusNoContent {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
-		}
-		return errors.New("failed to increment metric")
+		return requestError(code, body, errs, "failed to import metrics")
 	}
 
 	return nil
 }
 
-func (c *Client) CreateUpdate(key, description string, value interface{}) error {
-	_ = c.Create(key, description)
-	return c.Update(key, value)
+// ClientBatch collects operations that are sent to the server in a single request, see Client.Batch.
+type ClientBatch struct {
+	client        *Client
+	items         []BatchItem
+	transactional bool
+	err           error
 }
 
-func (c *Client) Read(key string) (float64, error) {
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodGet)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s", c.addr, key))
+// Batch starts a batch of operations that is applied by the server in order and without
+// interleaving changes of other requests once it's committed.
+func (c *Client) Batch() *ClientBatch {
+	return &ClientBatch{client: c}
+}
 
-	if err := a.Parse(); err != nil {
-		return 0, err
+// Transactional makes the server roll back all operations of the batch if one of them fails.
+func (b *ClientBatch) Transactional() *ClientBatch {
+	b.transactional = true
+	return b
+}
+
+func (b *ClientBatch) Create(key, description string, typ MetricType, labels ...string) *ClientBatch {
+	return b.append(BatchItem{Op: BatchCreate, Key: key, Description: description, Type: typ, LabelNames: labels})
+}
+
+func (b *ClientBatch) CreateHistogram(key, description string, buckets []float64, labels ...string) *ClientBatch {
+	return b.append(BatchItem{Op: BatchCreate, Key: key, Description: description, Type: Histogram, Buckets: buckets, LabelNames: labels})
+}
+
+func (b *ClientBatch) CreateSummary(key, description string, objectives map[float64]float64, labels ...string) *ClientBatch {
+	return b.append(BatchItem{Op: BatchCreate, Key: key, Description: description, Type: Summary, Objectives: formatObjectives(objectives), LabelNames: labels})
+}
+
+func (b *ClientBatch) Update(key string, value interface{}, labels ...Labels) *ClientBatch {
+	return b.appendValue(BatchSet, key, value, labels)
+}
+
+func (b *ClientBatch) Add(key string, value interface{}, labels ...Labels) *ClientBatch {
+	return b.appendValue(BatchAdd, key, value, labels)
+}
+
+func (b *ClientBatch) Subtract(key string, value interface{}, labels ...Labels) *ClientBatch {
+	return b.appendValue(BatchSub, key, value, labels)
+}
+
+func (b *ClientBatch) Observe(key string, value interface{}, labels ...Labels) *ClientBatch {
+	return b.appendValue(BatchObserve, key, value, labels)
+}
+
+func (b *ClientBatch) Increment(key string, labels ...Labels) *ClientBatch {
+	return b.append(BatchItem{Op: BatchInc, Key: key, Labels: mergeLabels(labels...)})
+}
+
+func (b *ClientBatch) Decrement(key string, labels ...Labels) *ClientBatch {
+	return b.append(BatchItem{Op: BatchDec, Key: key, Labels: mergeLabels(labels...)})
+}
+
+func (b *ClientBatch) Delete(key string, labels ...Labels) *ClientBatch {
+	return b.append(BatchItem{Op: BatchDelete, Key: key, Labels: mergeLabels(labels...)})
+}
+
+func (b *ClientBatch) appendValue(op BatchOp, key string, value interface{}, labels []Labels) *ClientBatch {
+	v, ok := interfaceToFloat64(value)
+	if !ok {
+		if b.err == nil {
+			b.err = fmt.Errorf("could not parse value of %s operation on %s", op, key)
+		}
+		return b
 	}
+	return b.append(BatchItem{Op: op, Key: key, Value: v, Labels: mergeLabels(labels...)})
+}
+
+func (b *ClientBatch) append(item BatchItem) *ClientBatch {
+	b.items = append(b.items, item)
+	return b
+}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+// Len returns the number of operations in the batch.
+func (b *ClientBatch) Len() int {
+	return len(b.items)
+}
+
+// Commit sends the batch and returns the result of every operation. An error is returned
+// if the batch could not be sent, was rolled back or if any of its operations failed.
+func (b *ClientBatch) Commit() ([]BatchResult, error) {
+	return b.CommitCtx(context.Background())
+}
+
+// CommitCtx is like Commit but the context limits the time of the request and its retries.
+func (b *ClientBatch) CommitCtx(ctx context.Context) ([]BatchResult, error) {
+	if b.err != nil {
+		return nil, b.err
 	}
-	code, body, errs := a.Bytes()
+	return b.client.commit(ctx, b.items, b.transactional)
+}
 
-	if code != fiber.StatusOK {
-		if len(errs) > 0 {
-			return 0, errors.Join(errs...)
+func (c *Client) commit(ctx context.Context, items []BatchItem, transactional bool) ([]BatchResult, error) {
+	return c.commitWithKey(ctx, items, transactional, uuid.NewString())
+}
+
+// commitWithKey is like commit but with the given idempotency key.
+func (c *Client) commitWithKey(ctx context.Context, items []BatchItem, transactional bool, key string) ([]BatchResult, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if transactional {
+		query.Set("transactional", "true")
+	}
+	code, body, errs := c.sendWithKey(ctx, fiber.MethodPost, "__batch", query, string(data), key)
+
+	if code != fiber.StatusOK && code != fiber.StatusConflict {
+		return nil, requestError(code, body, errs, "failed to commit batch")
+	}
+	results := []BatchResult{}
+	if err := json.Unmarshal(body, &results); err != nil {
+		// conflicts other than a rollback don't have results
+		return nil, requestError(code, body, errs, "failed to commit batch")
+	}
+	_, aborted := errorStatus(errBatchAborted)
+	failed := 0
+	var first *BatchResult
+	for i, res := range results {
+		if res.Error != "" && res.Error != aborted {
+			failed++
+			if first == nil {
+				first = &results[i]
+			}
 		}
+	}
+	if code == fiber.StatusConflict && first != nil {
+		return results, fmt.Errorf("batch was rolled back: %s: %s", first.Key, first.Error)
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d batch operations failed, first: %s: %s", failed, len(results), first.Key, first.Error)
+	}
+	return results, nil
+}
+
+// Flush sends the buffered and spooled changes, see WithBuffer and WithSpool.
+// It also returns the errors of failed periodic flushes and replays.
+func (c *Client) Flush() error {
+	return c.FlushCtx(context.Background())
+}
 
-		return 0, errors.New("failed to read metric")
+// FlushCtx is like Flush but the context limits the time of the requests and their retries.
+func (c *Client) FlushCtx(ctx context.Context) error {
+	errs := []error{}
+	if c.buffer != nil {
+		errs = append(errs, c.buffer.lastError(), c.buffer.flush(ctx))
+	}
+	if c.spool != nil {
+		errs = append(errs, c.spool.lastError(), c.spool.replay(ctx))
 	}
+	return errors.Join(errs...)
+}
 
-	if v, ok := interfaceToFloat64(body); ok {
-		return v, nil
+// Close stops the periodic flushes and replays and sends the remaining buffered and spooled changes,
+// see WithBuffer and WithSpool. Changes that can't be sent stay in the spool file.
+func (c *Client) Close() error {
+	errs := []error{}
+	if c.buffer != nil {
+		errs = append(errs, c.buffer.lastError(), c.buffer.close())
+	}
+	if c.spool != nil {
+		errs = append(errs, c.spool.lastError(), c.spool.close())
 	}
+	return errors.Join(errs...)
+}
 
-	return 0, errors.New("failed to parse read metric")
+// requestError prefers transport errors and falls back to the error returned by the server.
+// Transport errors and server errors are wrapped in an *unavailableError.
+func requestError(code int, body []byte, errs []error, msg string) error {
+	var err error
+	switch {
+	case len(errs) > 0:
+		err = errors.Join(errs...)
+	case len(body) > 0:
+		err = fmt.Errorf("%s: %s", msg, body)
+	default:
+		err = errors.New(msg)
+	}
+	if len(errs) > 0 || code >= fiber.StatusInternalServerError {
+		return &unavailableError{err}
+	}
+	return err
 }
 
-func (c *Client) Delete(key string) error {
-	a := fiber.AcquireAgent()
-	req := a.Request()
-	req.Header.SetMethod(fiber.MethodDelete)
-	req.Header.Set("authorization", "token "+c.apiKey)
-	req.SetRequestURI(fmt.Sprintf("%s/%s", c.addr, key))
+// unavailableError is returned if the server could not be reached or failed to handle the request,
+// so the request can be retried later.
+type unavailableError struct {
+	err error
+}
 
-	if err := a.Parse(); err != nil {
-		return err
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+// ClientOption configures optional behaviour of a Client.
+type ClientOption func(c *Client)
+
+// WithBuffer makes the client buffer updates, increments and adds and send them with a single batch
+// every interval or once changes of size series (at most 5000) are buffered. Increments and adds of a series are summed up,
+// an update replaces the buffered changes of its series. Errors of the periodic flushes are returned by
+// the next Flush or Close, errors of flushes due to the size by the call that filled the buffer.
+// Without a spool, the changes of a flush that failed because the server is unavailable stay buffered.
+// Read and Delete flush the buffer first so they see and don't precede the buffered changes.
+// Call Close to send the remaining changes before the client is discarded.
+func WithBuffer(interval time.Duration, size int) ClientOption {
+	return func(c *Client) {
+		c.bufferInterval = interval
+		c.bufferSize = size
 	}
+}
 
-	if c.allowSelfSigned {
-		a = a.InsecureSkipVerify()
+// WithSpool makes the client keep changes the server could not accept, because it's unreachable or failed,
+// in the given file and replay them in order once it's available again. The call that spooled a change
+// returns no error. While changes are spooled all further changes are spooled as well, so they can't overtake
+// them. At most size changes are spooled (default 100000), overflow decides which are discarded beyond that
+// (SpoolDropNewest if empty).
+// Spooled changes are replayed every second and by Flush and Close, a new client replays the changes left
+// in the file by its predecessor. Describe, Import and RestoreSnapshot are never spooled.
+// With a spool, changes are sent as batches whose idempotency key is kept with them in the file, so a change
+// whose response was lost is applied only once even if it's replayed after a restart.
+func WithSpool(file string, size int, overflow SpoolOverflow) ClientOption {
+	return func(c *Client) {
+		c.spoolFile = file
+		c.spoolSize = size
+		c.spoolOverflow = overflow
 	}
-	code, _, errs := a.Bytes()
+}
 
-	if code != fiber.StatusNoContent {
-		if len(errs) > 0 {
-			return errors.Join(errs...)
-		}
+// WithClientCertificate makes the client present the certificate in the given PEM files, so a server
+// with WithClientCA can authenticate it without an API key. The files are read for every new connection,
+// so a renewed certificate is used without creating a new client.
+func WithClientCertificate(keyFile, certFile string) ClientOption {
+	return func(c *Client) {
+		c.keyFile = keyFile
+		c.certFile = certFile
+	}
+}
+
+// WithSigning makes the client sign every request with an HMAC-SHA256 of its method, path, query, body,
+// timestamp and a nonce, using the secret of the API key. The key then only identifies the client, so it's
+// useless to anyone who sees it, e.g. a TLS-terminating proxy. The clock of the client must be within the
+// signature window of the server, see WithSignatureWindow.
+func WithSigning(secret string) ClientOption {
+	return func(c *Client) {
+		c.secret = secret
+	}
+}
 
-		return errors.New("failed to delete metric")
+// WithTimeout limits the time of each attempt of a request, a deadline of the context
+// of a ...Ctx method limits the time of all attempts. Without, requests have no timeout.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = timeout
 	}
+}
 
-	return nil
+// WithRetry retries requests that failed because the server could not be reached or responded with a
+// 5xx or 429 status, except changes the server could not persist, up to the given number of times (default 3). The delay before a retry is random, up to
+// the minimum backoff (default 100ms) doubled for each previous retry and limited by the maximum backoff
+// (default 5s). Changes are sent with an X-Idempotency-Key header that is the same for all attempts, so
+// the server applies a change only once even if an attempt failed after the server handled it.
+func WithRetry(retries int, minBackoff, maxBackoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retries = retries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
 }
 
-func NewClient(host string, port int, apiKey string, allowSelfSigned bool) *Client {
+func NewClient(host string, port int, apiKey string, allowSelfSigned bool, opts ...ClientOption) *Client {
 	c := &Client{
 		addr:            fmt.Sprintf("https://%s:%d", host, port),
 		apiKey:          apiKey,
 		allowSelfSigned: allowSelfSigned,
+		retries:         3,
+		minBackoff:      100 * time.Millisecond,
+		maxBackoff:      5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.tlsConfig = &tls.Config{InsecureSkipVerify: c.allowSelfSigned}
+	if c.certFile != "" && c.keyFile != "" {
+		keyFile, certFile := c.keyFile, c.certFile
+		c.tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	if c.bufferInterval > 0 {
+		// a series takes up to two operations of a batch, an update and an add
+		if c.bufferSize <= 0 || c.bufferSize > maxBatchItems/2 {
+			c.bufferSize = maxBatchItems / 2
+		}
+		c.buffer = newBuffer(c, c.bufferInterval, c.bufferSize)
+	}
+	if c.spoolFile != "" {
+		if c.spoolSize <= 0 {
+			c.spoolSize = 100000
+		}
+		c.spool = newSpool(c, c.spoolFile, c.spoolSize, c.spoolOverflow)
 	}
 	return c
 }
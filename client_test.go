@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startServer starts a server with the options and the admin key "key" on a free port and returns the port.
+// The server is shut down when the test ends.
+func startServer(t *testing.T, srvOpts []ServerOption, keys ...APIKey) (*Server, int) {
+	t.Helper()
+	dir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	srv := NewServer("127.0.0.1", port, filepath.Join(dir, "state"), srvOpts...)
+	srv.AddAPIKey("key")
+	for _, k := range keys {
+		if err := srv.addAPIKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Start(filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem"))
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	for i := 0; i < 250; i++ {
+		select {
+		case err := <-errs:
+			t.Fatalf("server could not be started: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+			conn.Close()
+			return srv, port
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("server did not start listening")
+	return nil, 0
+}
+
+func TestRetriedAddAfterFailedPersist(t *testing.T) {
+	store := newFailingStore()
+	_, port := startServer(t, []ServerOption{WithStateStore(store)})
+	c := NewClient("127.0.0.1", port, "key", true, WithRetry(3, time.Millisecond, 10*time.Millisecond))
+	if err := c.Create("c", "counter", Counter); err != nil {
+		t.Fatal(err)
+	}
+
+	store.setFail(true)
+	if err := c.Add("c", 1); err == nil {
+		t.Fatal("add succeeded although it could not be persisted")
+	}
+	if n := store.failures(); n != 1 {
+		t.Errorf("change that could not be persisted was sent %d times", n)
+	}
+	store.setFail(false)
+	if v, err := c.Read("c"); err != nil || v != 0 {
+		t.Errorf("c is %v (%v) after the failed add, expected 0", v, err)
+	}
+
+	if err := c.Add("c", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Read("c"); err != nil || v != 1 {
+		t.Errorf("c is %v (%v) after the retried add, expected 1", v, err)
+	}
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ClientCertificate maps the name of a client certificate, its common name or one of its DNS, email
+// or URI subject alternative names, to the permissions of the client, see WithClientCA. The scope
+// and prefixes restrict the client like the ones of an APIKey.
+type ClientCertificate struct {
+	Name     string
+	Scope    Scope
+	Prefixes []string
+}
+
+// certificateNames returns the common name and the subject alternative names of the certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// newClientCertificate validates the scope and normalizes the prefixes of a client certificate.
+// The permissions are kept as *APIKey, so requests are authorized the same way for both.
+func newClientCertificate(cc ClientCertificate) (*APIKey, error) {
+	if cc.Name == "" {
+		return nil, errors.New("client certificate without name")
+	}
+	return newAPIKey(APIKey{Key: cc.Name, Scope: cc.Scope, Prefixes: cc.Prefixes})
+}
+
+// certificateKey returns the permissions of the verified client certificate of the connection
+// or nil if there is none or its names are unknown.
+func (srv *Server) certificateKey(state *tls.ConnectionState) *APIKey {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	names := certificateNames(state.VerifiedChains[0][0])
+	srv.keysLock.RLock()
+	defer srv.keysLock.RUnlock()
+	for _, name := range names {
+		if k, ok := srv.clientCerts[name]; ok {
+			return k
+		}
+	}
+	return nil
+}
+
+// AddClientCertificate lets clients with a certificate of the given name, signed by the CA of WithClientCA,
+// authenticate without an API key. Adding a name that already exists replaces its scope and prefixes.
+func (srv *Server) AddClientCertificate(name string, scope Scope, prefixes ...string) error {
+	k, err := newClientCertificate(ClientCertificate{Name: name, Scope: scope, Prefixes: prefixes})
+	if err != nil {
+		return err
+	}
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	srv.clientCerts[name] = k
+	return nil
+}
+
+// RemoveClientCertificate revokes the permissions of certificates with the given name, requests in flight
+// are finished. It returns whether the name existed.
+func (srv *Server) RemoveClientCertificate(name string) bool {
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	_, ok := srv.clientCerts[name]
+	delete(srv.clientCerts, name)
+	return ok
+}
+
+// SetClientCertificates replaces all client certificates at once, e.g. after the configuration was reloaded.
+// Nothing is changed if one of them is invalid.
+func (srv *Server) SetClientCertificates(certs []ClientCertificate) error {
+	clientCerts, err := newClientCertificates(certs)
+	if err != nil {
+		return err
+	}
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	srv.clientCerts = clientCerts
+	return nil
+}
+
+// newClientCertificates validates the client certificates and returns their permissions by name.
+func newClientCertificates(certs []ClientCertificate) (map[string]*APIKey, error) {
+	clientCerts := make(map[string]*APIKey, len(certs))
+	for _, cc := range certs {
+		k, err := newClientCertificate(cc)
+		if err != nil {
+			return nil, err
+		}
+		clientCerts[cc.Name] = k
+	}
+	return clientCerts, nil
+}
+
+// SetClientCA replaces the CA client certificates are verified with, e.g. after it was renewed.
+// New connections use it, established ones stay open.
+func (srv *Server) SetClientCA(caFile string) error {
+	pool, err := loadClientCA(caFile)
+	if err != nil {
+		return err
+	}
+	srv.certLock.Lock()
+	defer srv.certLock.Unlock()
+	srv.clientCAs = pool
+	return nil
+}
+
+// loadClientCA reads the certificates of the CA file into a pool.
+func loadClientCA(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: cannot read client CA file %q: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates found in client CA file %q", caFile)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS configuration for a new connection with the current certificate and client CA.
+func (srv *Server) tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	srv.certLock.RLock()
+	defer srv.certLock.RUnlock()
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: srv.getCertificate,
+	}
+	if srv.clientCAs != nil {
+		conf.ClientCAs = srv.clientCAs
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if srv.clientCARequired {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return conf, nil
+}
+
+// GenerateCA writes the key and certificate of a local CA that signs client certificates, valid for 10 years.
+func GenerateCA(commonName, keyFile, certFile string) error {
+	if fileExists(keyFile) || fileExists(certFile) {
+		return fmt.Errorf("%s or %s already exists", keyFile, certFile)
+	}
+	tml := x509.Certificate{
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(10, 0, 0),
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"metric-nexus"},
+		},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	return createCertificate(&tml, nil, nil, keyFile, certFile)
+}
+
+// GenerateClientCertificate writes the key and certificate of a client with the given common name,
+// signed by the CA and valid for the given duration.
+func GenerateClientCertificate(caKeyFile, caCertFile, name string, validity time.Duration, keyFile, certFile string) error {
+	if fileExists(keyFile) || fileExists(certFile) {
+		return fmt.Errorf("%s or %s already exists", keyFile, certFile)
+	}
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: cannot load CA key pair from certFile=%q and keyFile=%q: %w", caCertFile, caKeyFile, err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing CA certificate failed: %s", err.Error())
+	}
+	tml := x509.Certificate{
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(validity),
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{"metric-nexus"},
+		},
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return createCertificate(&tml, caCert, ca.PrivateKey, keyFile, certFile)
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	crashHelperEnv     = "METRIC_NEXUS_CRASH_HELPER" // backend and durability of the server of the helper process
+	crashDirEnv        = "METRIC_NEXUS_CRASH_DIR"
+	crashWrites        = 200 // increments sent by the helper process
+	crashKillAfter     = 50  // acknowledged increments after which on-write and batched servers are killed
+	crashFlushInterval = 50 * time.Millisecond
+)
+
+// TestCrashHelper runs a server in the helper process of the crash tests. It increments a counter
+// and prints every acknowledged increment until it's killed.
+func TestCrashHelper(t *testing.T) {
+	mode := os.Getenv(crashHelperEnv)
+	if mode == "" {
+		t.Skip("only runs as helper process of the crash tests")
+	}
+	backend, durability, _ := strings.Cut(mode, "/")
+	dir := os.Getenv(crashDirEnv)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	srv := NewServer("127.0.0.1", port, filepath.Join(dir, "state"),
+		WithStateBackend(StateBackend(backend)),
+		WithDurability(Durability(durability), 5*time.Millisecond),
+		WithFlushInterval(crashFlushInterval),
+	)
+	srv.AddAPIKey("key")
+	go func() {
+		fmt.Println("error", srv.Start(filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem")))
+	}()
+
+	c := NewClient("127.0.0.1", port, "key", true, WithRetry(50, 10*time.Millisecond, 100*time.Millisecond))
+	if err := c.Create("crash_total", "increments acknowledged before the crash", Counter); err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	for i := 1; i <= crashWrites; i++ {
+		if err := c.Increment("crash_total"); err != nil {
+			fmt.Println("error", err)
+			return
+		}
+		fmt.Println("acked", i)
+	}
+	fmt.Println("done")
+	select {}
+}
+
+// crash runs a server with the backend and durability in a helper process and kills it without
+// a shutdown after the given number of acknowledged increments, or once all are acknowledged
+// and the given delay passed if acked is 0. It returns the number of acknowledged increments.
+func crash(t *testing.T, dir string, backend StateBackend, durability Durability, acked int, delay time.Duration) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHelper$")
+	cmd.Env = append(os.Environ(), crashHelperEnv+"="+string(backend)+"/"+string(durability), crashDirEnv+"="+dir)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	n := 0
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "error"):
+			t.Fatalf("helper process failed: %s", line)
+		case strings.HasPrefix(line, "acked "):
+			n, _ = strconv.Atoi(strings.TrimPrefix(line, "acked "))
+			if n == acked {
+				return n
+			}
+		case line == "done":
+			time.Sleep(delay)
+			return n
+		}
+	}
+	t.Fatalf("helper process exited after %d acknowledged increments", n)
+	return n
+}
+
+// crashValue reopens the state of the killed server and returns the value of its counter.
+func crashValue(t *testing.T, dir string, backend StateBackend) float64 {
+	t.Helper()
+	store, err := newStateStore(backend, filepath.Join(dir, "state"), DurabilityOnWrite, time.Millisecond, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	metrics, err := store.Load()
+	if err != nil {
+		t.Fatalf("state could not be loaded after the crash: %v", err)
+	}
+	for _, m := range metrics {
+		if m.Key == "crash_total" {
+			if len(m.Series) != 1 {
+				t.Fatalf("counter has %d series after the crash", len(m.Series))
+			}
+			return m.Series[0].Value
+		}
+	}
+	t.Fatal("counter was lost in the crash")
+	return 0
+}
+
+func TestCrashLoss(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crash tests start a server per backend and durability")
+	}
+	for _, backend := range []StateBackend{BackendYAML, BackendJSONLines, BackendBolt} {
+		for _, durability := range []Durability{DurabilityOnWrite, DurabilityBatched, DurabilityInterval} {
+			backend, durability := backend, durability
+			t.Run(string(backend)+"/"+string(durability), func(t *testing.T) {
+				t.Parallel()
+				dir := t.TempDir()
+				switch durability {
+				case DurabilityInterval:
+					// acknowledged increments are only guaranteed to survive once a flush interval passed
+					acked := crash(t, dir, backend, durability, 0, 5*crashFlushInterval)
+					if v := crashValue(t, dir, backend); v != float64(acked) {
+						t.Errorf("counter is %v after the crash, want the %d increments acknowledged a flush interval before", v, acked)
+					}
+				default:
+					// every acknowledged increment survives, the ones in flight may or may not
+					acked := crash(t, dir, backend, durability, crashKillAfter, 0)
+					if v := crashValue(t, dir, backend); v < float64(acked) || v > crashWrites {
+						t.Errorf("counter is %v after the crash, want at least the %d acknowledged increments", v, acked)
+					}
+				}
+			})
+		}
+	}
+}
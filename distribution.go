@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	defaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+)
+
+// distributionCollector exposes the series of a histogram or summary. Unlike
+// prometheus.HistogramVec and prometheus.SummaryVec it can be restored from the state file.
+type distributionCollector struct {
+	desc   *prometheus.Desc
+	metric *metric
+}
+
+func (d *distributionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.desc
+}
+
+func (d *distributionCollector) Collect(ch chan<- prometheus.Metric) {
+	m := d.metric
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, s := range m.series {
+		if m.typ == Histogram {
+			// the +Inf bucket is implicit, the total count covers it
+			ch <- prometheus.MustNewConstHistogram(d.desc, s.count, s.sum, s.cumulativeCounts(m.buckets), s.values...)
+			continue
+		}
+		ch <- prometheus.MustNewConstSummary(d.desc, s.count, s.sum, s.quantiles(m.objectives), s.values...)
+	}
+}
+
+func newDistributionCollector(m *metric) *distributionCollector {
+	return &distributionCollector{
+		desc:   prometheus.NewDesc(m.key, m.description, m.labels, nil),
+		metric: m,
+	}
+}
+
+func validBuckets(buckets []float64) bool {
+	for i := range buckets {
+		if math.IsNaN(buckets[i]) || (i > 0 && buckets[i] <= buckets[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameDistribution returns whether the metric has the buckets, if it's a histogram, and the objectives, if it's a summary.
+func (m *metric) sameDistribution(buckets []float64, objectives map[float64]float64) bool {
+	switch m.typ {
+	case Histogram:
+		if len(buckets) != len(m.buckets) {
+			return false
+		}
+		for i := range buckets {
+			if buckets[i] != m.buckets[i] {
+				return false
+			}
+		}
+	case Summary:
+		if len(objectives) != len(m.objectives) {
+			return false
+		}
+		for q, e := range objectives {
+			if me, ok := m.objectives[q]; !ok || me != e {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func validObjectives(objectives map[float64]float64) bool {
+	for q, e := range objectives {
+		if q <= 0 || q >= 1 || e < 0 || e >= 1 {
+			return false
+		}
+	}
+	return true
+}
@@ -20,7 +20,7 @@ func startServer() {
 
 func startClient() {
 	client := metrics.NewClient("127.0.0.1", 3000, apiKey, true)
-	if err := client.Create("uptime", "metric server uptime"); err != nil {
+	if err := client.Create("uptime", "metric server uptime", metrics.Gauge); err != nil {
 		panic(err)
 	}
 
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ImportMode defines how imported metrics are combined with the existing ones.
+type ImportMode string
+
+const (
+	ImportMerge   ImportMode = "merge"   // imported series overwrite existing ones, other series are kept
+	ImportReplace ImportMode = "replace" // all existing metrics are removed first
+	ImportSkip    ImportMode = "skip"    // metrics that already exist are left untouched
+)
+
+func parseImportMode(s string) (ImportMode, bool) {
+	switch m := ImportMode(s); m {
+	case "":
+		return ImportMerge, true
+	case ImportMerge, ImportReplace, ImportSkip:
+		return m, true
+	}
+	return "", false
+}
+
+// invalidImport describes why an import was rejected.
+func invalidImport(err error) error {
+	return &fiber.Error{
+		Code:    errInvalidImport.Code,
+		Message: fmt.Sprintf("%s: %s", errInvalidImport.Message, err.Error()),
+	}
+}
+
+// ParseState parses an export or state file in JSON or YAML format, older YAML formats are upgraded.
+func ParseState(data []byte) (*State, error) {
+	c := &State{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, c); err != nil {
+			return nil, err
+		}
+		if c.Version > stateVersion {
+			return nil, fmt.Errorf("%w: %d > %d", errNewerVersion, c.Version, stateVersion)
+		}
+	} else {
+		metrics, err := parseYAMLState(data)
+		if err != nil {
+			return nil, err
+		}
+		c.Metrics = metrics
+	}
+	c.Version = stateVersion
+	return c, nil
+}
+
+// Export returns a copy of all metrics with their series.
+func (srv *Server) Export() []StateMetric {
+	return srv.state.copyMetrics()
+}
+
+// Import adds the given metrics, e.g. from the export of another server. All metrics are
+// validated before anything is changed, with ImportMerge existing metrics must have the same type, labels, buckets and objectives
+// and their series must accept the imported values, e.g. counters can't decrease.
+func (srv *Server) Import(metrics []StateMetric, mode ImportMode) error {
+	mode, ok := parseImportMode(string(mode))
+	if !ok {
+		return errInvalidImportMode
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	// restoring into a server without state validates the metrics without side effects,
+	// merged metrics start with their current series so the values are validated against them
+	scratch := NewServer("", 0, "")
+	for _, mtr := range metrics {
+		key := sanitizeKey(mtr.Key)
+		if m, ok := srv.data[key]; ok && mode == ImportMerge {
+			if typ, _ := parseMetricType(string(mtr.Type)); typ != m.typ {
+				return errTypeMismatch
+			}
+			if !sameLabelNames(m.labels, mtr.Labels) {
+				return errLabelMismatch
+			}
+			if !m.sameDistribution(mtr.Buckets, mtr.Objectives) {
+				return errDistributionMismatch
+			}
+			if _, ok := scratch.data[key]; !ok {
+				if sm, ok := srv.state.get(key); ok {
+					if err := scratch.restore(sm); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := scratch.restore(mtr); err != nil {
+			return invalidImport(err)
+		}
+	}
+
+	switch mode {
+	case ImportReplace:
+		return srv.replaceMetrics(metrics)
+	case ImportSkip:
+		missing := []StateMetric{}
+		for _, mtr := range metrics {
+			if _, ok := srv.data[sanitizeKey(mtr.Key)]; !ok {
+				missing = append(missing, mtr)
+			}
+		}
+		metrics = missing
+	}
+	for _, mtr := range metrics {
+		if err := srv.restore(mtr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceMetrics removes all metrics and restores the given ones, the caller must hold the lock.
+func (srv *Server) replaceMetrics(metrics []StateMetric) error {
+	keys := []string{}
+	for k := range srv.data {
+		keys = append(keys, k)
+	}
+	srv.data = map[string]*metric{}
+	if err := srv.rebuildRegistry(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := srv.state.Remove(k); err != nil {
+			return err
+		}
+	}
+	for _, mtr := range metrics {
+		if err := srv.restore(mtr); err != nil {
+			return err
+		}
+	}
+	return srv.state.save()
+}
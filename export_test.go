@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestImportDistributionMismatch(t *testing.T) {
+	srv := newStoreServer(t, newFailingStore())
+	if _, err := srv.CreateHistogram("h", "histogram", []float64{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.CreateSummary("s", "summary", map[float64]float64{0.5: 0.05}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Observe("h", 2.5); err != nil {
+		t.Fatal(err)
+	}
+	histogram := func(buckets ...float64) StateMetric {
+		return StateMetric{Key: "h", Type: Histogram, Buckets: buckets, Series: []StateSeries{{Count: 3, Sum: 3, BucketCounts: []uint64{3, 0, 0}}}}
+	}
+	summary := func(objectives map[float64]float64) StateMetric {
+		return StateMetric{Key: "s", Type: Summary, Objectives: objectives, Series: []StateSeries{{Count: 1, Sum: 1, Samples: []float64{1}}}}
+	}
+
+	for name, tc := range map[string]struct {
+		metrics []StateMetric
+		code    int
+	}{
+		"other bounds":         {[]StateMetric{histogram(1, 2, 4)}, errDistributionMismatch.Code},
+		"other bucket count":   {[]StateMetric{histogram(1, 2)}, errDistributionMismatch.Code},
+		"other objectives":     {[]StateMetric{summary(map[float64]float64{0.9: 0.01})}, errDistributionMismatch.Code},
+		"other errors":         {[]StateMetric{summary(map[float64]float64{0.5: 0.01})}, errDistributionMismatch.Code},
+		"conflicting imported": {[]StateMetric{{Key: "n", Type: Histogram, Buckets: []float64{1}}, {Key: "n", Type: Histogram, Buckets: []float64{2}}}, errInvalidImport.Code},
+	} {
+		err := srv.Import(tc.metrics, ImportMerge)
+		var fe *fiber.Error
+		if !errors.As(err, &fe) || fe.Code != tc.code {
+			t.Errorf("%s: expected error %d, got %v", name, tc.code, err)
+		}
+	}
+	if v, _ := srv.Read("h"); v != 1 {
+		t.Errorf("histogram has %v observations after rejected imports, expected 1", v)
+	}
+	if _, ok := srv.Read("n"); ok {
+		t.Error("metric of a rejected import exists")
+	}
+
+	if err := srv.Import([]StateMetric{histogram(1, 2, 3), summary(map[float64]float64{0.5: 0.05})}, ImportMerge); err != nil {
+		t.Fatalf("import with the same buckets and objectives failed: %v", err)
+	}
+	if v, _ := srv.Read("h"); v != 3 {
+		t.Errorf("histogram has %v observations after the import, expected 3", v)
+	}
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// fileStore keeps the state in a YAML file and logs changes to a write-ahead log
+// until the next save compacts them into the file.
+type fileStore struct {
+	file       string
+	durability Durability
+	interval   time.Duration
+	wal        *wal
+}
+
+// Load reads the snapshot from the state file and replays the mutations of its write-ahead log.
+func (fs *fileStore) Load() ([]StateMetric, error) {
+	metrics, errLoad := readStateFile(fs.file, []byte(stateDefault), parseYAMLState)
+	var corrupt *CorruptStateError
+	if errLoad != nil && !errors.As(errLoad, &corrupt) {
+		return nil, errLoad
+	}
+
+	muts, err := readWAL(walFile(fs.file))
+	if err != nil {
+		return nil, err
+	}
+	fs.wal, err = openWAL(walFile(fs.file), fs.durability, fs.interval)
+	if err != nil {
+		return nil, err
+	}
+	if corrupt != nil {
+		corrupt.Mutations = muts
+		return nil, corrupt
+	}
+
+	c := &State{Metrics: metrics}
+	for _, mut := range muts {
+		c.applyLocked(mut)
+	}
+	return c.Metrics, nil
+}
+
+// Save atomically writes the metrics to the state file and truncates
+// the write-ahead log, its mutations are part of the snapshot now.
+func (fs *fileStore) Save(metrics []StateMetric) error {
+	data, err := marshalState(metrics)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(fs.file, data, 0644); err != nil {
+		return err
+	}
+
+	if fs.wal != nil {
+		return fs.wal.truncate()
+	}
+	if err := os.Remove(walFile(fs.file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (fs *fileStore) Apply(mut Mutation) error {
+	if fs.wal == nil {
+		return errors.New("state store is not loaded")
+	}
+	return fs.wal.append(mut)
+}
+
+func (fs *fileStore) Wait() {
+	if fs.wal != nil {
+		fs.wal.syncer.Wait()
+	}
+}
+
+func (fs *fileStore) Close() error {
+	if fs.wal == nil {
+		return nil
+	}
+	err := fs.wal.close()
+	fs.wal = nil
+	return err
+}
+
+func newFileStore(file string, durability Durability, interval time.Duration) *fileStore {
+	return &fileStore{
+		file:       file,
+		durability: durability,
+		interval:   interval,
+	}
+}
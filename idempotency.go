@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// headerIdempotencyKey carries the UUID that identifies a change and all retries of it.
+const headerIdempotencyKey = "X-Idempotency-Key"
+
+var boltResponses = []byte("responses") // bucket with the responses by idempotency key
+
+// errNotStored makes the idempotency middleware skip storing a failed response, it's never sent.
+var errNotStored = errors.New("response is not stored")
+
+// idempotencyStore is the fiber.Storage of the idempotency middleware. It keeps the responses
+// in a bbolt database, so retries of requests that were handled before a restart are still
+// answered with the original response instead of being applied again.
+// Every value is prefixed with its expiry in Unix nanoseconds.
+type idempotencyStore struct {
+	db *bolt.DB
+}
+
+func (is *idempotencyStore) Get(key string) ([]byte, error) {
+	var val []byte
+	err := is.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltResponses).Get([]byte(key))
+		if len(v) < 8 || expired(v, time.Now()) {
+			return nil
+		}
+		val = append([]byte{}, v[8:]...)
+		return nil
+	})
+	return val, err
+}
+
+func (is *idempotencyStore) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+	v := make([]byte, 8, 8+len(val))
+	expiry := int64(0) // never
+	if exp > 0 {
+		expiry = time.Now().Add(exp).UnixNano()
+	}
+	binary.BigEndian.PutUint64(v, uint64(expiry))
+	v = append(v, val...)
+	return is.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltResponses).Put([]byte(key), v)
+	})
+}
+
+func (is *idempotencyStore) Delete(key string) error {
+	return is.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltResponses).Delete([]byte(key))
+	})
+}
+
+func (is *idempotencyStore) Reset() error {
+	return is.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltResponses); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(boltResponses)
+		return err
+	})
+}
+
+func (is *idempotencyStore) Close() error {
+	return is.db.Close()
+}
+
+// prune removes the expired responses.
+func (is *idempotencyStore) prune(now time.Time) error {
+	return is.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltResponses).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) < 8 || expired(v, now) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// expired returns whether the expiry prefix of the value is before now.
+func expired(v []byte, now time.Time) bool {
+	expiry := int64(binary.BigEndian.Uint64(v[:8]))
+	return expiry != 0 && expiry < now.UnixNano()
+}
+
+// openIdempotencyStore opens the database with the given file. The responses are only kept
+// to recognize retries, so a database that can't be read is replaced by an empty one.
+func openIdempotencyStore(file string) (*idempotencyStore, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) || errors.Is(err, bolt.ErrVersionMismatch) {
+		if errRemove := os.Remove(file); errRemove != nil {
+			return nil, errors.Join(err, errRemove)
+		}
+		db, err = bolt.Open(file, 0644, &bolt.Options{Timeout: time.Second})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltResponses)
+		return err
+	}); err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	return &idempotencyStore{db: db}, nil
+}
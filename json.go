@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// jsonFloat encodes NaN and infinities, which JSON numbers can't represent, as strings.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return json.Marshal(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return json.Marshal(v)
+}
+
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*f = jsonFloat(v)
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+func toJSONFloats(values []float64) []jsonFloat {
+	if values == nil {
+		return nil
+	}
+	f := make([]jsonFloat, len(values))
+	for i, v := range values {
+		f[i] = jsonFloat(v)
+	}
+	return f
+}
+
+func fromJSONFloats(values []jsonFloat) []float64 {
+	if values == nil {
+		return nil
+	}
+	f := make([]float64, len(values))
+	for i, v := range values {
+		f[i] = float64(v)
+	}
+	return f
+}
+
+// jsonTime omits zero times, encoding/json doesn't omit empty structs.
+func jsonTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+type jsonSeries struct {
+	Labels       Labels      `json:"labels,omitempty"`
+	Value        jsonFloat   `json:"value"`
+	Count        uint64      `json:"count,omitempty"`
+	Sum          jsonFloat   `json:"sum,omitempty"`
+	BucketCounts []uint64    `json:"bucket_counts,omitempty"`
+	Samples      []jsonFloat `json:"samples,omitempty"`
+	Updated      *time.Time  `json:"updated,omitempty"`
+}
+
+func (ss StateSeries) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonSeries{
+		Labels:       ss.Labels,
+		Value:        jsonFloat(ss.Value),
+		Count:        ss.Count,
+		Sum:          jsonFloat(ss.Sum),
+		BucketCounts: ss.BucketCounts,
+		Samples:      toJSONFloats(ss.Samples),
+		Updated:      jsonTime(ss.Updated),
+	})
+}
+
+func (ss *StateSeries) UnmarshalJSON(data []byte) error {
+	js := jsonSeries{}
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	*ss = StateSeries{
+		Labels:       js.Labels,
+		Value:        float64(js.Value),
+		Count:        js.Count,
+		Sum:          float64(js.Sum),
+		BucketCounts: js.BucketCounts,
+		Samples:      fromJSONFloats(js.Samples),
+	}
+	if js.Updated != nil {
+		ss.Updated = *js.Updated
+	}
+	return nil
+}
+
+// jsonMetric stores the objectives with string keys, JSON objects can't have numeric keys.
+type jsonMetric struct {
+	Key         string             `json:"key"`
+	Description string             `json:"description"`
+	Type        MetricType         `json:"type"`
+	Labels      []string           `json:"labels,omitempty"`
+	Buckets     []jsonFloat        `json:"buckets,omitempty"`
+	Objectives  map[string]float64 `json:"objectives,omitempty"`
+	Series      []StateSeries      `json:"series"`
+}
+
+func (sm StateMetric) MarshalJSON() ([]byte, error) {
+	jm := jsonMetric{
+		Key:         sm.Key,
+		Description: sm.Description,
+		Type:        sm.Type,
+		Labels:      sm.Labels,
+		Buckets:     toJSONFloats(sm.Buckets),
+		Series:      sm.Series,
+	}
+	if sm.Objectives != nil {
+		jm.Objectives = map[string]float64{}
+		for q, e := range sm.Objectives {
+			jm.Objectives[strconv.FormatFloat(q, 'g', -1, 64)] = e
+		}
+	}
+	return json.Marshal(jm)
+}
+
+func (sm *StateMetric) UnmarshalJSON(data []byte) error {
+	jm := jsonMetric{}
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+	*sm = StateMetric{
+		Key:         jm.Key,
+		Description: jm.Description,
+		Type:        jm.Type,
+		Labels:      jm.Labels,
+		Buckets:     fromJSONFloats(jm.Buckets),
+		Series:      jm.Series,
+	}
+	if jm.Objectives != nil {
+		sm.Objectives = map[float64]float64{}
+		for q, e := range jm.Objectives {
+			fq, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				return err
+			}
+			sm.Objectives[fq] = e
+		}
+	}
+	return nil
+}
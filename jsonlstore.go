@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonLinesStore keeps the state as one JSON mutation per line. Saving rewrites the file
+// with one put per metric, the changes in between are appended as further lines.
+type jsonLinesStore struct {
+	file       string
+	durability Durability
+	interval   time.Duration
+	lock       *sync.Mutex // guards out, which is replaced on save
+	out        *os.File
+	syncer     *syncer
+}
+
+// parseJSONLinesState applies the mutations of the lines to an empty state.
+func parseJSONLinesState(data []byte) ([]StateMetric, error) {
+	c := &State{Metrics: []StateMetric{}}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		mut := Mutation{}
+		err := json.Unmarshal(line, &mut)
+		if err == nil && !completeMutation(mut) {
+			err = errors.New("mutation without value")
+		}
+		if err != nil {
+			if i == len(lines)-1 {
+				break // the last line was torn by a crash during the write and therefore never acknowledged
+			}
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		c.applyLocked(mut)
+	}
+	return c.Metrics, nil
+}
+
+// completeMutation returns whether the mutation and those of a batch have the values of their op.
+func completeMutation(mut Mutation) bool {
+	for _, m := range mut.Mutations {
+		if !completeMutation(m) {
+			return false
+		}
+	}
+	return !(mut.Op == MutationPut && mut.Metric == nil) && !(mut.Op == MutationPutSeries && mut.Series == nil)
+}
+
+func (js *jsonLinesStore) Load() ([]StateMetric, error) {
+	metrics, errLoad := readStateFile(js.file, []byte{}, parseJSONLinesState)
+	var corrupt *CorruptStateError
+	if errLoad != nil && !errors.As(errLoad, &corrupt) {
+		return nil, errLoad
+	}
+	if err := js.open(); err != nil {
+		return nil, err
+	}
+	js.syncer = newSyncer(js.durability, js.interval, js.sync)
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return metrics, nil
+}
+
+// open opens the file for appending mutations.
+func (js *jsonLinesStore) open() error {
+	f, err := os.OpenFile(js.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	if js.out != nil {
+		_ = js.out.Close()
+	}
+	js.out = f
+	return nil
+}
+
+func (js *jsonLinesStore) sync() error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	return js.out.Sync()
+}
+
+// Save atomically replaces the file with one put per metric.
+func (js *jsonLinesStore) Save(metrics []StateMetric) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for i := range metrics {
+		if err := enc.Encode(Mutation{Op: MutationPut, Key: metrics[i].Key, Metric: &metrics[i]}); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(js.file, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if js.syncer == nil {
+		return nil
+	}
+	// the renamed file is a new one, appending to the old one would lose the mutations
+	if err := js.open(); err != nil {
+		return err
+	}
+	return js.syncer.sync()
+}
+
+func (js *jsonLinesStore) Apply(mut Mutation) error {
+	if js.syncer == nil {
+		return errors.New("state store is not loaded")
+	}
+	line, err := json.Marshal(mut)
+	if err != nil {
+		return err
+	}
+	js.lock.Lock()
+	_, err = js.out.Write(append(line, '\n'))
+	js.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return js.syncer.wrote()
+}
+
+func (js *jsonLinesStore) Wait() {
+	if js.syncer != nil {
+		js.syncer.Wait()
+	}
+}
+
+func (js *jsonLinesStore) Close() error {
+	if js.syncer == nil {
+		return nil
+	}
+	err := js.syncer.close()
+	js.syncer = nil
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	return errors.Join(err, js.out.Close())
+}
+
+func newJSONLinesStore(file string, durability Durability, interval time.Duration) *jsonLinesStore {
+	return &jsonLinesStore{
+		file:       file,
+		durability: durability,
+		interval:   interval,
+		lock:       &sync.Mutex{},
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeJSONLinesState persists a counter with the given values as lines of the store, without a save.
+func writeJSONLinesState(t *testing.T, file string, values ...float64) {
+	t.Helper()
+	js := newJSONLinesStore(file, DurabilityOnWrite, time.Minute)
+	if _, err := js.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &State{}
+	s.open(js)
+	if err := s.Put(StateMetric{Key: "c", Type: Counter}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if err := s.PutSeries("c", nil, StateSeries{Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := js.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, file, data string) {
+	t.Helper()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTornJSONLines(t *testing.T) {
+	for name, tail := range map[string]string{
+		"line":     `{"op":"put_series","key":"c","series":{"val`,
+		"value":    `{"op":"put_series","key":"c"}`,
+		"brackets": `{"op":"put_series","key":"c","series":{"value":3}`,
+	} {
+		tail := tail
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "state.jsonl")
+			writeJSONLinesState(t, file, 1, 2)
+			appendFile(t, file, tail)
+
+			if v := loadCounter(t, newJSONLinesStore(file, DurabilityOnWrite, time.Minute)); v != 2 {
+				t.Errorf("counter is %v, want the value of the last complete line", v)
+			}
+		})
+	}
+}
+
+func TestCorruptJSONLines(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.jsonl")
+	writeJSONLinesState(t, file, 1)
+	// a broken line that is followed by others wasn't torn by a crash
+	appendFile(t, file, "{\"op\":\n{\"op\":\"put_series\",\"key\":\"c\",\"series\":{\"value\":2}}\n")
+
+	js := newJSONLinesStore(file, DurabilityOnWrite, time.Minute)
+	defer js.Close()
+	_, err := js.Load()
+	var corrupt *CorruptStateError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("got error %v, want a corrupt state", err)
+	}
+	if _, err := os.Stat(corrupt.Copy); err != nil {
+		t.Errorf("copy of the corrupt file: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	reLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Labels are the label pairs identifying one series of a metric.
+type Labels map[string]string
+
+// Names returns the sorted label names.
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for n := range l {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l Labels) query() url.Values {
+	q := url.Values{}
+	for n, v := range l {
+		q.Set(n, v)
+	}
+	return q
+}
+
+// mergeLabels combines the given label sets, later sets overwrite earlier ones.
+func mergeLabels(labels ...Labels) Labels {
+	res := Labels{}
+	for _, l := range labels {
+		for n, v := range l {
+			res[n] = v
+		}
+	}
+	return res
+}
+
+// validLabelNames returns whether the names can label a metric of the given type. Histograms can't
+// have an "le" and summaries no "quantile" label, these are the labels of their buckets and quantiles.
+func validLabelNames(typ MetricType, names []string) bool {
+	seen := map[string]bool{}
+	for _, n := range names {
+		if !reLabelName.MatchString(n) || strings.HasPrefix(n, "__") || seen[n] {
+			return false
+		}
+		if (typ == Histogram && n == "le") || (typ == Summary && n == "quantile") {
+			return false
+		}
+		seen[n] = true
+	}
+	return true
+}
+
+func sameLabelNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseLabelNames(s string) []string {
+	names := []string{}
+	if s == "" {
+		return names
+	}
+	for _, n := range strings.Split(s, ",") {
+		names = append(names, strings.TrimSpace(n))
+	}
+	return names
+}
+
+// seriesID identifies a series by its label values in the order of the label names.
+func seriesID(values []string) string {
+	return strings.Join(values, "\xff")
+}
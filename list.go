@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListFilter selects the metrics returned by List.
+type ListFilter struct {
+	Prefix string // only keys starting with the prefix
+	Regex  string // only keys matching the regular expression
+	Offset int    // number of matching metrics to skip
+	Limit  int    // maximum number of metrics to return, defaults to 100 and is capped at 1000
+}
+
+// MetricInfo describes a metric without its series.
+type MetricInfo struct {
+	Key         string     `json:"key"`
+	Description string     `json:"description"`
+	Type        MetricType `json:"type"`
+	Labels      []string   `json:"labels,omitempty"`
+	Series      int        `json:"series"`          // number of series
+	Value       *float64   `json:"value,omitempty"` // value of unlabelled metrics, the number of observations of histograms and summaries
+	Updated     time.Time  `json:"updated"`         // last change of any series
+}
+
+func (mi MetricInfo) MarshalJSON() ([]byte, error) {
+	type plain MetricInfo // without the methods, avoids the recursion
+	jmi := struct {
+		plain
+		Value *jsonFloat `json:"value,omitempty"`
+	}{plain: plain(mi)}
+	if mi.Value != nil {
+		v := jsonFloat(*mi.Value)
+		jmi.Value = &v
+	}
+	return json.Marshal(jmi)
+}
+
+func (mi *MetricInfo) UnmarshalJSON(data []byte) error {
+	type plain MetricInfo
+	jmi := struct {
+		*plain
+		Value *jsonFloat `json:"value,omitempty"`
+	}{plain: (*plain)(mi)}
+	if err := json.Unmarshal(data, &jmi); err != nil {
+		return err
+	}
+	mi.Value = nil
+	if jmi.Value != nil {
+		v := float64(*jmi.Value)
+		mi.Value = &v
+	}
+	return nil
+}
+
+// MetricList is a page of the metrics matching a ListFilter, sorted by key.
+type MetricList struct {
+	Total   int          `json:"total"` // number of matching metrics
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+	Metrics []MetricInfo `json:"metrics"`
+}
+
+// info describes the metric.
+func (m *metric) info() MetricInfo {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mi := MetricInfo{
+		Key:         m.key,
+		Description: m.description,
+		Type:        m.typ,
+		Labels:      m.labels,
+		Series:      len(m.series),
+	}
+	for _, s := range m.series {
+		if s.updated.After(mi.Updated) {
+			mi.Updated = s.updated
+		}
+		if len(m.labels) == 0 {
+			v := s.value
+			if m.typ == Histogram || m.typ == Summary {
+				v = float64(s.count)
+			}
+			mi.Value = &v
+		}
+	}
+	return mi
+}
+
+// List returns the metrics matching the filter, sorted by key.
+func (srv *Server) List(filter ListFilter) (*MetricList, error) {
+	return srv.list(filter, nil)
+}
+
+// list is List restricted to the metrics the given function allows, e.g. the ones an API key covers.
+func (srv *Server) list(filter ListFilter, allow func(key string) bool) (*MetricList, error) {
+	if filter.Offset < 0 || filter.Limit < 0 {
+		return nil, errInvalidFilter
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultListLimit
+	}
+	if filter.Limit > maxListLimit {
+		filter.Limit = maxListLimit
+	}
+	var re *regexp.Regexp
+	if filter.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(filter.Regex); err != nil {
+			return nil, errInvalidFilter
+		}
+	}
+
+	srv.lock.Lock()
+	keys := []string{}
+	for k := range srv.data {
+		if strings.HasPrefix(k, filter.Prefix) && (re == nil || re.MatchString(k)) && (allow == nil || allow(k)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	list := &MetricList{
+		Total:   len(keys),
+		Offset:  filter.Offset,
+		Limit:   filter.Limit,
+		Metrics: []MetricInfo{},
+	}
+	for i := filter.Offset; i < len(keys) && i < filter.Offset+filter.Limit; i++ {
+		list.Metrics = append(list.Metrics, srv.data[keys[i]].info())
+	}
+	srv.lock.Unlock()
+	return list, nil
+}
@@ -1,71 +1,311 @@
 package metrics
 
 import (
+	"fmt"
+	"math"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// MetricType defines how a metric behaves and how it is exposed to Prometheus.
+type MetricType string
+
+const (
+	Gauge     MetricType = "gauge"     // can be set to any value
+	Counter   MetricType = "counter"   // can only go up
+	Histogram MetricType = "histogram" // counts observations in buckets
+	Summary   MetricType = "summary"   // calculates quantiles of observations
+)
+
+func parseMetricType(s string) (MetricType, bool) {
+	switch t := MetricType(strings.ToLower(strings.TrimSpace(s))); t {
+	case "":
+		return Gauge, true // metrics created before types existed are gauges
+	case Gauge, Counter, Histogram, Summary:
+		return t, true
+	}
+	return "", false
+}
+
 type metric struct {
-	gauge       prometheus.Gauge
+	collector   prometheus.Collector // *prometheus.GaugeVec, *prometheus.CounterVec or *distributionCollector
 	lock        *sync.Mutex
 	key         string
+	typ         MetricType
 	description string
-	value       float64
+	labels      []string            // label names, fixed at creation
+	buckets     []float64           // histograms only
+	objectives  map[float64]float64 // summaries only
+	series      map[string]*series
+	state       *State // owned by the server the metric belongs to
+}
+
+// labelValues returns the values of the given labels in the order of the label names.
+// Values that aren't valid UTF-8 are rejected, Prometheus can't expose them.
+func (m *metric) labelValues(labels Labels) ([]string, error) {
+	if len(labels) != len(m.labels) {
+		return nil, errInvalidLabels
+	}
+	values := make([]string, len(m.labels))
+	for i, n := range m.labels {
+		v, ok := labels[n]
+		if !ok || !utf8.ValidString(v) {
+			return nil, errInvalidLabels
+		}
+		values[i] = v
+	}
+	return values, nil
 }
 
-func (m *metric) set(v interface{}) {
+// getSeries returns the series identified by the given labels, the caller must hold the lock.
+// A new series is only added to the metric once its first change was persisted, see commit.
+func (m *metric) getSeries(labels Labels) (*series, error) {
+	values, err := m.labelValues(labels)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := m.series[seriesID(values)]; ok {
+		return s, nil
+	}
+	return newSeries(values, len(m.buckets)), nil
+}
+
+// write sets the series to v changed at the given time, the caller must hold the lock.
+func (m *metric) write(s *series, v float64, updated time.Time) error {
+	if m.typ != Counter && m.typ != Gauge {
+		return errUnsupported
+	}
+	if m.typ == Counter && !(v >= s.value) { // also rejects NaN, which doesn't compare
+		return errCounterDecrease
+	}
+	next := s.clone()
+	next.value = v
+	next.updated = updated
+	delta := v - s.value
+	if err := m.commit(s, next); err != nil {
+		return err
+	}
+	switch c := m.collector.(type) {
+	case *prometheus.CounterVec:
+		c.WithLabelValues(s.values...).Add(delta)
+	case *prometheus.GaugeVec:
+		c.WithLabelValues(s.values...).Set(v)
+	}
+	return nil
+}
+
+// commit persists next as the new state of the series and only then replaces the series with it,
+// so a change that could not be persisted leaves no trace. The caller must hold the lock.
+func (m *metric) commit(s, next *series) error {
+	if err := m.state.PutSeries(m.key, m.labels, next.snapshot(m.labels)); err != nil {
+		return err
+	}
+	*s = *next
+	m.series[seriesID(s.values)] = s
+	return nil
+}
+
+// definition returns the state of the metric without its series.
+func (m *metric) definition() StateMetric {
+	return StateMetric{
+		Key:         m.key,
+		Description: m.description,
+		Type:        m.typ,
+		Labels:      m.labels,
+		Buckets:     m.buckets,
+		Objectives:  m.objectives,
+		Series:      []StateSeries{},
+	}
+}
+
+func (m *metric) set(v interface{}, labels Labels) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	if f, ok := interfaceToFloat64(v); ok {
-		m.gauge.Set(f)
-		m.value = f
-		if !state.SetValue(m.key, f) {
-			state.Append(m.key, m.description, m.value)
-		}
+	f, ok := interfaceToFloat64(v)
+	if !ok {
+		return errInvalidValue
+	}
+	s, err := m.getSeries(labels)
+	if err != nil {
+		return err
 	}
+	return m.write(s, f, time.Now())
 }
 
-func (m *metric) add(v float64) float64 {
+func (m *metric) add(v float64, labels Labels) (float64, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	v = m.value + v
-	m.gauge.Set(v)
-	m.value = v
+	s, err := m.getSeries(labels)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(s.value+v) || math.IsInf(s.value+v, 0) {
+		return s.value, errInvalidValue
+	}
+	if err := m.write(s, s.value+v, time.Now()); err != nil {
+		return s.value, err
+	}
+	return s.value, nil
+}
 
-	_ = state.SetValue(m.key, v)
-	return v
+func (m *metric) sub(v float64, labels Labels) (float64, error) {
+	return m.add(-v, labels)
 }
 
-func (m *metric) sub(v float64) float64 {
-	return m.add(-v)
+func (m *metric) inc(labels Labels) (float64, error) {
+	return m.add(1, labels)
 }
 
-func (m *metric) inc() float64 {
-	return m.add(1)
+func (m *metric) dec(labels Labels) (float64, error) {
+	return m.sub(1, labels)
 }
 
-func (m *metric) dec() float64 {
-	return m.sub(1)
+func (m *metric) observe(v float64, labels Labels) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.typ != Histogram && m.typ != Summary {
+		return errUnsupported
+	}
+	s, err := m.getSeries(labels)
+	if err != nil {
+		return err
+	}
+	next := s.clone()
+	next.observe(v, m.typ, m.buckets)
+	return m.commit(s, next)
+}
+
+// get returns the value of gauges and counters
+// and the number of observations of histograms and summaries.
+func (m *metric) get(labels Labels) (float64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	values, err := m.labelValues(labels)
+	if err != nil {
+		return 0, err
+	}
+	s, ok := m.series[seriesID(values)]
+	if !ok {
+		return 0, errNotFound
+	}
+	if m.typ == Histogram || m.typ == Summary {
+		return float64(s.count), nil
+	}
+	return s.value, nil
+}
+
+// remove deletes the series identified by the given labels.
+func (m *metric) remove(labels Labels) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	values, err := m.labelValues(labels)
+	if err != nil {
+		return err
+	}
+	id := seriesID(values)
+	if _, ok := m.series[id]; !ok {
+		return errNotFound
+	}
+	if err := m.state.RemoveSeries(m.key, m.labels, values); err != nil {
+		return err
+	}
+	switch c := m.collector.(type) {
+	case *prometheus.GaugeVec:
+		c.DeleteLabelValues(values...)
+	case *prometheus.CounterVec:
+		c.DeleteLabelValues(values...)
+	}
+	delete(m.series, id)
+	return nil
 }
 
-func (m *metric) get() float64 {
+// newCollector creates a collector for the metric using its current description.
+func (m *metric) newCollector() prometheus.Collector {
+	switch m.typ {
+	case Histogram, Summary:
+		return newDistributionCollector(m)
+	case Counter:
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: m.key,
+			Help: m.description,
+		}, m.labels)
+	default:
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: m.key,
+			Help: m.description,
+		}, m.labels)
+	}
+}
+
+// describe changes the help text of the metric by replacing its collector,
+// the values of all series are carried over to the new collector.
+// The caller has to register the new collector.
+func (m *metric) describe(description string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	return m.value
+	if err := m.state.SetDescription(m.key, description); err != nil {
+		return err
+	}
+	m.description = description
+	m.collector = m.newCollector()
+	for _, s := range m.series {
+		switch c := m.collector.(type) {
+		case *prometheus.GaugeVec:
+			c.WithLabelValues(s.values...).Set(s.value)
+		case *prometheus.CounterVec:
+			c.WithLabelValues(s.values...).Add(s.value)
+		}
+	}
+	return nil
 }
 
-func newMetric(key, description string) *metric {
+func (m *metric) restore(sm StateMetric) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, ss := range sm.Series {
+		s, err := m.getSeries(ss.Labels)
+		if err != nil {
+			return fmt.Errorf("metric %s has a series with invalid labels %v", m.key, ss.Labels)
+		}
+		if m.typ == Gauge || m.typ == Counter {
+			if err := m.write(s, ss.Value, ss.Updated); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.typ == Histogram && len(ss.BucketCounts) != len(m.buckets) {
+			return fmt.Errorf("metric %s has %d bucket counts but %d buckets", m.key, len(ss.BucketCounts), len(m.buckets))
+		}
+		next := s.clone()
+		next.restore(ss)
+		if err := m.commit(s, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMetric(reg prometheus.Registerer, st *State, key, description string, typ MetricType, labels []string, buckets []float64, objectives map[float64]float64) (*metric, error) {
 	mc := &metric{
-		gauge: promauto.NewGauge(prometheus.GaugeOpts{
-			Name: key,
-			Help: description,
-		}),
 		lock:        &sync.Mutex{},
 		key:         key,
+		typ:         typ,
 		description: description,
-		value:       0.0,
+		labels:      labels,
+		series:      map[string]*series{},
+		state:       st,
+	}
+	if typ == Histogram || typ == Summary {
+		mc.buckets = buckets
+		mc.objectives = objectives
+	}
+	mc.collector = mc.newCollector()
+	if err := reg.Register(mc.collector); err != nil {
+		return nil, errRegistration
 	}
-	return mc
+	return mc, nil
 }
@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// failingStore is a StateStore that keeps the metrics in memory and fails to persist changes while fail is set.
+type failingStore struct {
+	lock    *sync.Mutex
+	fail    bool
+	metrics []StateMetric
+	applied int // changes persisted successfully
+	failed  int // changes that failed to persist
+}
+
+func newFailingStore() *failingStore {
+	return &failingStore{lock: &sync.Mutex{}}
+}
+
+func (fs *failingStore) Load() ([]StateMetric, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.metrics, nil
+}
+
+func (fs *failingStore) Save(metrics []StateMetric) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.fail {
+		return errors.New("disk full")
+	}
+	fs.metrics = metrics
+	return nil
+}
+
+func (fs *failingStore) Apply(mut Mutation) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.fail {
+		fs.failed++
+		return errors.New("disk full")
+	}
+	fs.applied++
+	return nil
+}
+
+func (fs *failingStore) Close() error {
+	return nil
+}
+
+func (fs *failingStore) failures() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.failed
+}
+
+func (fs *failingStore) setFail(fail bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.fail = fail
+}
+
+// newStoreServer returns a server that persists its changes with the store, without starting it.
+func newStoreServer(t *testing.T, store StateStore) *Server {
+	t.Helper()
+	srv := NewServer("127.0.0.1", 0, filepath.Join(t.TempDir(), "state"))
+	srv.state.open(store)
+	return srv
+}
+
+// exposition returns the metrics the server exposes to Prometheus.
+func exposition(t *testing.T, srv *Server) string {
+	t.Helper()
+	srv.lock.Lock()
+	reg := srv.registry
+	srv.lock.Unlock()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(mfs)
+}
+
+func TestFailedPersistLeavesNoTrace(t *testing.T) {
+	store := newFailingStore()
+	srv := newStoreServer(t, store)
+	for _, create := range []func() error{
+		func() error { _, err := srv.Create("c", "counter", Counter); return err },
+		func() error { _, err := srv.Create("g", "gauge", Gauge, "host"); return err },
+		func() error { _, err := srv.CreateHistogram("h", "histogram", []float64{1, 2}); return err },
+		func() error { _, err := srv.CreateSummary("s", "summary", nil); return err },
+	} {
+		if err := create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.Add("c", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Update("g", 3, Labels{"host": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Observe("h", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Observe("s", 1.5); err != nil {
+		t.Fatal(err)
+	}
+
+	before, state := exposition(t, srv), srv.state.copyMetrics()
+	store.setFail(true)
+	for name, change := range map[string]func() error{
+		"add":            func() error { return srv.Add("c", 1) },
+		"increment":      func() error { return srv.Increment("c") },
+		"update":         func() error { return srv.Update("g", 4, Labels{"host": "a"}) },
+		"new series":     func() error { return srv.Update("g", 4, Labels{"host": "b"}) },
+		"observe":        func() error { return srv.Observe("h", 0.5) },
+		"observe sample": func() error { return srv.Observe("s", 0.5) },
+		"describe":       func() error { return srv.Describe("c", "changed") },
+		"delete series":  func() error { return srv.Delete("g", Labels{"host": "a"}) },
+		"delete":         func() error { return srv.Delete("h") },
+		"create":         func() error { _, err := srv.Create("n", "new", Gauge); return err },
+	} {
+		if err := change(); err != errPersistence {
+			t.Errorf("%s: expected the persistence error, got %v", name, err)
+		}
+	}
+	if after := exposition(t, srv); after != before {
+		t.Errorf("exposition changed by failed changes:\n%s\n%s", before, after)
+	}
+	if after := srv.state.copyMetrics(); !reflect.DeepEqual(after, state) {
+		t.Errorf("state changed by failed changes:\n%+v\n%+v", state, after)
+	}
+	for key, want := range map[string]float64{"c": 5, "h": 1, "s": 1} {
+		if v, ok := srv.Read(key); !ok || v != want {
+			t.Errorf("%s is %v (%v), expected %v", key, v, ok, want)
+		}
+	}
+	if v, ok := srv.Read("g", Labels{"host": "a"}); !ok || v != 3 {
+		t.Errorf("g{host=a} is %v (%v), expected 3", v, ok)
+	}
+	if _, ok := srv.Read("g", Labels{"host": "b"}); ok {
+		t.Error("series that could not be persisted exists")
+	}
+	if _, ok := srv.Read("n"); ok {
+		t.Error("metric that could not be persisted exists")
+	}
+
+	// once the store works again, the changes are applied exactly once
+	store.setFail(false)
+	if err := srv.Add("c", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := srv.Read("c"); v != 6 {
+		t.Errorf("c is %v after the store recovered, expected 6", v)
+	}
+	if _, err := srv.Create("n", "new", Gauge); err != nil {
+		t.Errorf("metric could not be created after the store recovered: %v", err)
+	}
+}
+
+func TestNonFiniteValues(t *testing.T) {
+	srv := newStoreServer(t, newFailingStore())
+	if _, err := srv.Create("c", "counter", Counter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Create("g", "gauge", Gauge); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Update("c", 100); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{"nan", "inf", math.NaN(), math.Inf(1)} {
+		if err := srv.Update("c", v); err != errInvalidValue {
+			t.Errorf("counter set to %v: expected the invalid value error, got %v", v, err)
+		}
+		if err := srv.Add("g", v); err != errInvalidValue {
+			t.Errorf("gauge added %v: expected the invalid value error, got %v", v, err)
+		}
+	}
+	if err := srv.Update("c", 1); err != errCounterDecrease {
+		t.Errorf("counter decreased after a rejected NaN: %v", err)
+	}
+	if v, _ := srv.Read("c"); v != 100 {
+		t.Errorf("counter is %v, expected 100", v)
+	}
+
+	if err := srv.Update("g", math.MaxFloat64); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Add("g", math.MaxFloat64); err != errInvalidValue {
+		t.Errorf("gauge added up to infinity: %v", err)
+	}
+	if v, _ := srv.Read("g"); v != math.MaxFloat64 {
+		t.Errorf("gauge is %v, expected %v", v, math.MaxFloat64)
+	}
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stateVersion is the version of the state file format written by this version of the library.
+const stateVersion = 1
+
+// errNewerVersion is returned for state files written by a newer version of the library,
+// those aren't corrupt and must not be replaced by a recovered snapshot.
+var errNewerVersion = errors.New("state file version is newer than the supported version")
+
+// migration upgrades a raw state file by one version and returns a description of every change.
+type migration func(raw map[string]interface{}) []string
+
+// migrations[i] upgrades a state file from version i to version i+1.
+var migrations = []migration{
+	migrateUnversioned,
+}
+
+// migrateUnversioned upgrades state files written before the format was versioned.
+// Those store a single value per metric and may lack the metric type.
+func migrateUnversioned(raw map[string]interface{}) []string {
+	changes := []string{}
+	metrics, _ := raw["metrics"].([]interface{})
+	for _, m := range metrics {
+		mtr, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key := mtr["key"]
+		if t, _ := mtr["type"].(string); t == "" {
+			mtr["type"] = string(Gauge)
+			changes = append(changes, fmt.Sprintf("metric %v: set the missing type to %s", key, Gauge))
+		}
+		_, hasSeries := mtr["series"]
+		labels, _ := mtr["labels"].([]interface{})
+		if !hasSeries && len(labels) == 0 {
+			value := mtr["value"]
+			if value == nil {
+				value = 0
+			}
+			mtr["series"] = []interface{}{map[string]interface{}{"value": value}}
+			changes = append(changes, fmt.Sprintf("metric %v: moved the value %v into a series", key, value))
+		}
+		if _, ok := mtr["value"]; ok {
+			delete(mtr, "value")
+			if hasSeries {
+				changes = append(changes, fmt.Sprintf("metric %v: dropped the value that was superseded by its series", key))
+			}
+		}
+	}
+	return changes
+}
+
+// migrateState upgrades the raw state file to the current version.
+func migrateState(raw map[string]interface{}) ([]string, error) {
+	version, _ := raw["version"].(int)
+	if version > stateVersion {
+		return nil, fmt.Errorf("%w: %d > %d", errNewerVersion, version, stateVersion)
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("state file version %d is invalid", version)
+	}
+	changes := []string{}
+	for v := version; v < stateVersion; v++ {
+		changes = append(changes, migrations[v](raw)...)
+		changes = append(changes, fmt.Sprintf("upgraded from version %d to %d", v, v+1))
+	}
+	raw["version"] = stateVersion
+	return changes, nil
+}
+
+// parseYAMLState parses a YAML snapshot of the state, upgrading older versions of the format.
+func parseYAMLState(data []byte) ([]StateMetric, error) {
+	metrics, _, err := parseVersionedState(data)
+	return metrics, err
+}
+
+// parseVersionedState parses a YAML snapshot of the state and returns the changes made by migrations.
+func parseVersionedState(data []byte) ([]StateMetric, []string, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	header := struct {
+		Version int `yaml:"version"`
+	}{}
+	if err := doc.Decode(&header); err != nil {
+		return nil, nil, err
+	}
+	c := &State{}
+	if header.Version == stateVersion {
+		if err := doc.Decode(c); err != nil {
+			return nil, nil, err
+		}
+		return c.Metrics, nil, nil
+	}
+
+	raw := map[string]interface{}{}
+	if err := doc.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	changes, err := migrateState(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrated, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := yaml.Unmarshal(migrated, c); err != nil {
+		return nil, nil, err
+	}
+	return c.Metrics, changes, nil
+}
+
+// marshalState returns the YAML snapshot of the metrics in the current version of the format.
+func marshalState(metrics []StateMetric) ([]byte, error) {
+	return yaml.Marshal(&State{Version: stateVersion, Metrics: metrics})
+}
+
+// MigrateStateFile upgrades the YAML state file to the current version of the format and returns
+// a description of every change. The original file is kept as <file>.v<version>.bak.
+func MigrateStateFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	metrics, changes, err := parseVersionedState(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return changes, nil
+	}
+	header := struct {
+		Version int `yaml:"version"`
+	}{}
+	_ = yaml.Unmarshal(data, &header)
+	if err := writeFileAtomic(fmt.Sprintf("%s.v%d.bak", file, header.Version), data, 0644); err != nil {
+		return nil, err
+	}
+	migrated, err := marshalState(metrics)
+	if err != nil {
+		return nil, err
+	}
+	return changes, writeFileAtomic(file, migrated, 0644)
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// maxSummarySamples is the number of most recent observations
+	// a summary uses to calculate its quantiles.
+	maxSummarySamples = 1000
+)
+
+// series is one labelled instance of a metric.
+type series struct {
+	values  []string  // label values in the order of the metric's label names
+	value   float64   // gauges and counters only
+	counts  []uint64  // observations per bucket (not cumulative), histograms only
+	samples []float64 // most recent observations, summaries only
+	count   uint64
+	sum     float64
+	updated time.Time // last change of the value or observations
+}
+
+func (s *series) observe(v float64, typ MetricType, buckets []float64) {
+	s.count++
+	s.sum += v
+	s.updated = time.Now()
+	if typ == Histogram {
+		for i, upper := range buckets {
+			if v <= upper {
+				s.counts[i]++
+				break
+			}
+		}
+		return
+	}
+	s.samples = append(s.samples, v)
+	if len(s.samples) > maxSummarySamples {
+		s.samples = s.samples[len(s.samples)-maxSummarySamples:]
+	}
+}
+
+// cumulativeCounts returns the number of observations per bucket upper bound including all lower buckets.
+func (s *series) cumulativeCounts(buckets []float64) map[float64]uint64 {
+	res := make(map[float64]uint64, len(buckets))
+	cumulative := uint64(0)
+	for i, upper := range buckets {
+		cumulative += s.counts[i]
+		res[upper] = cumulative
+	}
+	return res
+}
+
+// quantiles calculates the objectives from the recent samples.
+func (s *series) quantiles(objectives map[float64]float64) map[float64]float64 {
+	res := make(map[float64]float64, len(objectives))
+	sorted := append([]float64{}, s.samples...)
+	sort.Float64s(sorted)
+	for q := range objectives {
+		if len(sorted) == 0 {
+			res[q] = math.NaN()
+			continue
+		}
+		res[q] = sorted[int(q*float64(len(sorted)-1))]
+	}
+	return res
+}
+
+func (s *series) snapshot(names []string) StateSeries {
+	ss := StateSeries{
+		Value:   s.value,
+		Count:   s.count,
+		Sum:     s.sum,
+		Updated: s.updated,
+	}
+	if len(names) > 0 {
+		ss.Labels = Labels{}
+		for i, n := range names {
+			ss.Labels[n] = s.values[i]
+		}
+	}
+	if s.counts != nil {
+		ss.BucketCounts = append([]uint64{}, s.counts...)
+	}
+	if s.samples != nil {
+		ss.Samples = append([]float64{}, s.samples...)
+	}
+	return ss
+}
+
+func (s *series) restore(ss StateSeries) {
+	s.count = ss.Count
+	s.sum = ss.Sum
+	copy(s.counts, ss.BucketCounts)
+	s.samples = append([]float64{}, ss.Samples...)
+	s.updated = ss.Updated
+}
+
+// clone returns a copy of the series that can be changed without changing the series.
+func (s *series) clone() *series {
+	c := *s
+	if s.counts != nil {
+		c.counts = append([]uint64{}, s.counts...)
+	}
+	if s.samples != nil {
+		c.samples = append([]float64{}, s.samples...)
+	}
+	return &c
+}
+
+func newSeries(values []string, buckets int) *series {
+	s := &series{
+		values: values,
+	}
+	if buckets > 0 {
+		s.counts = make([]uint64, buckets)
+	}
+	return s
+}
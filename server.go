@@ -1,14 +1,24 @@
 package metrics
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/idempotency"
 	"github.com/gofiber/fiber/v2/middleware/keyauth"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/valyala/fasthttp/fasthttpadaptor"
 )
@@ -22,155 +32,693 @@ var (
 		Code:    403001,
 		Message: "Invalid API key",
 	}
+	errSignature = &fiber.Error{
+		Code:    401000,
+		Message: "Request signature is missing or invalid",
+	}
+	errSignatureRequired = &fiber.Error{
+		Code:    401001,
+		Message: "API key requires signed requests",
+	}
+	errSignatureExpired = &fiber.Error{
+		Code:    401002,
+		Message: "Request timestamp is outside the signature window",
+	}
+	errNonceReused = &fiber.Error{
+		Code:    401003,
+		Message: "Request nonce was already used",
+	}
+	errInvalidValue = &fiber.Error{
+		Code:    400000,
+		Message: "Invalid value",
+	}
+	errInvalidType = &fiber.Error{
+		Code:    400001,
+		Message: "Invalid metric type",
+	}
+	errNotFound = &fiber.Error{
+		Code:    404000,
+		Message: "Metric not found",
+	}
+	errCounterDecrease = &fiber.Error{
+		Code:    409000,
+		Message: "Counters can not be decreased",
+	}
+	errInvalidBuckets = &fiber.Error{
+		Code:    400002,
+		Message: "Buckets must be in increasing order",
+	}
+	errInvalidObjectives = &fiber.Error{
+		Code:    400003,
+		Message: "Objectives must be quantiles between 0 and 1 with an error between 0 and 1",
+	}
+	errUnsupported = &fiber.Error{
+		Code:    405000,
+		Message: "Operation not supported by the metric type",
+	}
+	errInvalidLabels = &fiber.Error{
+		Code:    400004,
+		Message: "Labels do not match the label names of the metric",
+	}
+	errTypeMismatch = &fiber.Error{
+		Code:    409001,
+		Message: "Metric already exists with a different type",
+	}
+	errLabelMismatch = &fiber.Error{
+		Code:    409002,
+		Message: "Metric already exists with different label names",
+	}
+	errPersistence = &fiber.Error{
+		Code:    500000,
+		Message: "State could not be persisted",
+	}
+	errSnapshotNotFound = &fiber.Error{
+		Code:    404001,
+		Message: "Snapshot not found",
+	}
+	errInvalidImportMode = &fiber.Error{
+		Code:    400005,
+		Message: "Import mode must be merge, replace or skip",
+	}
+	errInvalidImport = &fiber.Error{
+		Code:    400006,
+		Message: "Import is invalid",
+	}
+	errInvalidFilter = &fiber.Error{
+		Code:    400007,
+		Message: "Filter must have a valid regular expression and a positive offset and limit",
+	}
+	errInvalidBatch = &fiber.Error{
+		Code:    400008,
+		Message: "Batch must be a JSON array of at most 10000 operations",
+	}
+	errInvalidBatchOp = &fiber.Error{
+		Code:    400009,
+		Message: "Batch operation must be create, set, add, sub, inc, dec, delete or observe",
+	}
+	errScope = &fiber.Error{
+		Code:    403002,
+		Message: "API key lacks the scope for this operation",
+	}
+	errPrefix = &fiber.Error{
+		Code:    403003,
+		Message: "API key is not allowed to access this metric",
+	}
+	errInvalidIdempotencyKey = &fiber.Error{
+		Code:    400010,
+		Message: "Idempotency key must be a UUID",
+	}
+	errBatchAborted = &fiber.Error{
+		Code:    409004,
+		Message: "Batch was rolled back because an operation failed",
+	}
+	errDistributionMismatch = &fiber.Error{
+		Code:    409005,
+		Message: "Metric already exists with different buckets or objectives",
+	}
+	errRegistration = &fiber.Error{
+		Code:    409003,
+		Message: "Metric collides with another collector of the registry",
+	}
 )
 
 type Server struct {
-	addr            string
-	stateFile       string
-	api             *fiber.App
-	lock            *sync.Mutex
-	apiKeys         []string
-	clientsLastSeen map[string]time.Time
-	data            map[string]*metric
+	addr             string
+	stateFile        string
+	api              *fiber.App
+	registry         *prometheus.Registry
+	collectors       []prometheus.Collector // registered in addition to the metrics
+	state            *State
+	recoverState     bool // restore the newest good snapshot if the state file is corrupt
+	hourlySnapshots  int  // number of hourly snapshots to keep
+	dailySnapshots   int  // number of daily snapshots to keep
+	flushInterval    time.Duration
+	durability       Durability
+	batchInterval    time.Duration // group commit interval of batched durability
+	backend          StateBackend
+	store            StateStore // replaces the store of the backend
+	idempotency      *idempotencyStore
+	idempotencyTTL   time.Duration // how long responses are kept for retries with the same idempotency key
+	signatureWindow  time.Duration // how far the timestamp of a signed request may be off
+	nonces           *nonceCache   // of signed requests
+	lock             *sync.Mutex
+	wg               *sync.WaitGroup // background loops
+	done             chan struct{}   // closed on shutdown
+	keysLock         *sync.RWMutex   // guards apiKeys
+	apiKeys          []*APIKey
+	keyCache         *keyCache          // verifications of hashed keys
+	clientCerts      map[string]*APIKey // permissions of client certificates by name, guarded by keysLock
+	certLock         *sync.RWMutex      // guards cert and clientCAs
+	cert             *tls.Certificate
+	clientCAs        *x509.CertPool // verifies client certificates, nil if they aren't used
+	clientCAFile     string
+	clientCARequired bool // refuse connections without a client certificate
+	clientsLastSeen  map[string]time.Time
+	data             map[string]*metric
 }
 
-func (srv *Server) Create(key, description string, value interface{}) bool {
+// Create creates a metric of the given type, histograms and summaries use the default buckets and objectives.
+// The optional label names define which labels every series of the metric must have.
+func (srv *Server) Create(key, description string, typ MetricType, labels ...string) (bool, error) {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
-	key = sanitizeKey(key)
-	if _, ok := srv.data[key]; !ok {
-		srv.data[key] = newMetric(key, description)
-		srv.data[key].set(value)
-		return true
+	return srv.create(key, description, typ, labels, prometheus.DefBuckets, defaultObjectives)
+}
+
+// CreateHistogram creates a histogram with the given bucket upper bounds.
+func (srv *Server) CreateHistogram(key, description string, buckets []float64, labels ...string) (bool, error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
 	}
-	return false
+	return srv.create(key, description, Histogram, labels, buckets, nil)
 }
 
-func (srv *Server) CreateUpdate(key, description string, value interface{}) {
+// CreateSummary creates a summary with the given quantile objectives.
+func (srv *Server) CreateSummary(key, description string, objectives map[float64]float64, labels ...string) (bool, error) {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
+	if len(objectives) == 0 {
+		objectives = defaultObjectives
+	}
+	return srv.create(key, description, Summary, labels, nil, objectives)
+}
+
+// create creates the metric unless it exists, the caller must hold the lock.
+func (srv *Server) create(key, description string, typ MetricType, labels []string, buckets []float64, objectives map[float64]float64) (bool, error) {
 	key = sanitizeKey(key)
-	if _, ok := srv.data[key]; !ok {
-		srv.data[key] = newMetric(key, description)
+	if labels == nil {
+		labels = []string{}
 	}
-	srv.data[key].set(value)
+	if m, ok := srv.data[key]; ok {
+		if m.typ != typ {
+			return false, errTypeMismatch
+		}
+		if !sameLabelNames(m.labels, labels) {
+			return false, errLabelMismatch
+		}
+		if m.description != description {
+			// re-creating a metric with a different description changes its help text
+			if err := m.describe(description); err != nil {
+				return false, err
+			}
+			return false, srv.rebuildRegistry()
+		}
+		return false, nil
+	}
+	if _, ok := parseMetricType(string(typ)); !ok {
+		return false, errInvalidType
+	}
+	if !validLabelNames(typ, labels) {
+		return false, errInvalidLabels
+	}
+	if typ != Histogram {
+		buckets = nil
+	} else if !validBuckets(buckets) {
+		return false, errInvalidBuckets
+	}
+	if typ != Summary {
+		objectives = nil
+	} else if !validObjectives(objectives) {
+		return false, errInvalidObjectives
+	}
+	m, err := newMetric(srv.registry, srv.state, key, description, typ, labels, buckets, objectives)
+	if err != nil {
+		return false, err
+	}
+	if err := srv.state.Put(m.definition()); err != nil {
+		srv.registry.Unregister(m.collector)
+		return false, err
+	}
+	srv.data[key] = m
+	if len(labels) > 0 {
+		// labelled series are created on first use
+		return true, nil
+	}
+	if typ == Histogram || typ == Summary {
+		return true, m.restore(StateMetric{Series: []StateSeries{{BucketCounts: make([]uint64, len(buckets))}}})
+	}
+	return true, m.set(0.0, nil)
 }
 
-func (srv *Server) Read(key string) (float64, bool) {
+// CreateUpdate creates the metric if it doesn't exist and sets the series identified by the given labels.
+// The label names of the metric are taken from the given labels.
+func (srv *Server) CreateUpdate(key, description string, typ MetricType, value interface{}, labels ...Labels) error {
+	l := mergeLabels(labels...)
+	if _, err := srv.Create(key, description, typ, l.Names()...); err != nil {
+		return err
+	}
+	return srv.Update(key, value, l)
+}
+
+func (srv *Server) Read(key string, labels ...Labels) (float64, bool) {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
 	key = sanitizeKey(key)
 	if mtr, ok := srv.data[key]; ok {
-		return mtr.get(), true
+		if v, err := mtr.get(mergeLabels(labels...)); err == nil {
+			return v, true
+		}
 	}
 	return 0, false
 }
 
-func (srv *Server) Update(key string, value interface{}) bool {
+func (srv *Server) Update(key string, value interface{}, labels ...Labels) error {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
-	key = sanitizeKey(key)
-	if _, ok := srv.data[key]; !ok {
-		return false
+	return srv.update(key, value, mergeLabels(labels...))
+}
+
+// update sets the series to the value, the caller must hold the lock.
+func (srv *Server) update(key string, value interface{}, labels Labels) error {
+	if m, ok := srv.data[sanitizeKey(key)]; ok {
+		return m.set(value, labels)
 	}
-	srv.data[key].set(value)
-	return true
+	return errNotFound
 }
 
-func (srv *Server) Delete(key string) bool {
+// Delete removes the metric or, if labels are given, only the series identified by them.
+func (srv *Server) Delete(key string, labels ...Labels) error {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
+	return srv.delete(key, mergeLabels(labels...))
+}
+
+// delete removes the metric or series, the caller must hold the lock.
+func (srv *Server) delete(key string, labels Labels) error {
 	key = sanitizeKey(key)
 	if m, ok := srv.data[key]; ok {
-		prometheus.DefaultRegisterer.Unregister(m.gauge)
+		if len(labels) > 0 {
+			return m.remove(labels)
+		}
+		if err := srv.state.Remove(key); err != nil {
+			return err
+		}
 		delete(srv.data, key)
-		return true
+		// the metric might be re-created with a different description or labels
+		return srv.rebuildRegistry()
 	}
-	return false
+	return errNotFound
 }
 
-func (srv *Server) Increment(key string) bool {
+// Describe changes the description of the metric without losing its values.
+func (srv *Server) Describe(key, description string) error {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
 	key = sanitizeKey(key)
 	if m, ok := srv.data[key]; ok {
-		m.inc()
-		return true
+		if m.description != description {
+			if err := m.describe(description); err != nil {
+				return err
+			}
+			return srv.rebuildRegistry()
+		}
+		return nil
 	}
-	return false
+	return errNotFound
 }
 
-func (srv *Server) Decrement(key string) bool {
+// rebuildRegistry replaces the registry with a new one containing all current metrics,
+// the caller must hold the lock. Registries remember the help text and label names of
+// every metric name they have seen, so changing them requires a new registry.
+func (srv *Server) rebuildRegistry() error {
+	reg := prometheus.NewRegistry()
+	for _, c := range srv.collectors {
+		if err := reg.Register(c); err != nil {
+			return errRegistration
+		}
+	}
+	for _, m := range srv.data {
+		if err := reg.Register(m.collector); err != nil {
+			return errRegistration
+		}
+	}
+	srv.registry = reg
+	return nil
+}
+
+func (srv *Server) Increment(key string, labels ...Labels) error {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
-	key = sanitizeKey(key)
-	if m, ok := srv.data[key]; ok {
-		m.dec()
-		return true
-	}
-	return false
+	return srv.add(key, 1, mergeLabels(labels...))
 }
 
-func (srv *Server) Add(key string, v interface{}) bool {
+func (srv *Server) Decrement(key string, labels ...Labels) error {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
-	key = sanitizeKey(key)
-	if m, ok := srv.data[key]; ok {
+	return srv.add(key, -1, mergeLabels(labels...))
+}
+
+func (srv *Server) Add(key string, v interface{}, labels ...Labels) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.add(key, v, mergeLabels(labels...))
+}
+
+func (srv *Server) Sub(key string, v interface{}, labels ...Labels) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	f, ok := interfaceToFloat64(v)
+	if !ok {
+		return errInvalidValue
+	}
+	return srv.add(key, -f, mergeLabels(labels...))
+}
+
+// add adds the value to the series, the caller must hold the lock.
+func (srv *Server) add(key string, v interface{}, labels Labels) error {
+	if m, ok := srv.data[sanitizeKey(key)]; ok {
 		if f, ok := interfaceToFloat64(v); ok {
-			m.add(f)
-			return true
+			_, err := m.add(f, labels)
+			return err
 		}
+		return errInvalidValue
 	}
-	return false
+	return errNotFound
 }
 
-func (srv *Server) Sub(key string, v interface{}) bool {
+func (srv *Server) Observe(key string, v interface{}, labels ...Labels) error {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
-	key = sanitizeKey(key)
-	if m, ok := srv.data[key]; ok {
+	return srv.observe(key, v, mergeLabels(labels...))
+}
+
+// observe adds the value as observation to the series, the caller must hold the lock.
+func (srv *Server) observe(key string, v interface{}, labels Labels) error {
+	if m, ok := srv.data[sanitizeKey(key)]; ok {
 		if f, ok := interfaceToFloat64(v); ok {
-			m.sub(f)
-			return true
+			return m.observe(f, labels)
 		}
+		return errInvalidValue
+	}
+	return errNotFound
+}
+
+// restore recreates a metric from the state file, the caller must hold the lock.
+func (srv *Server) restore(mtr StateMetric) error {
+	typ, ok := parseMetricType(string(mtr.Type))
+	if !ok {
+		return fmt.Errorf("metric %s has invalid type %q", mtr.Key, mtr.Type)
 	}
-	return false
+	if _, err := srv.create(mtr.Key, mtr.Description, typ, mtr.Labels, mtr.Buckets, mtr.Objectives); err != nil {
+		return fmt.Errorf("metric %s could not be restored: %s", mtr.Key, err.Error())
+	}
+	m := srv.data[sanitizeKey(mtr.Key)]
+	if !m.sameDistribution(mtr.Buckets, mtr.Objectives) {
+		// the counts and samples would be attributed to the wrong buckets and quantiles
+		return fmt.Errorf("metric %s could not be restored: %s", mtr.Key, errDistributionMismatch.Message)
+	}
+	return m.restore(mtr)
+}
+
+// Snapshots returns the rotated snapshots of the state, newest first.
+func (srv *Server) Snapshots() ([]Snapshot, error) {
+	return listSnapshots(srv.stateFile)
+}
+
+// RestoreSnapshot replaces all metrics with the ones of the snapshot with the given name.
+func (srv *Server) RestoreSnapshot(name string) error {
+	c, err := readSnapshot(srv.stateFile, name)
+	if err != nil {
+		return err
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.replaceMetrics(c.Metrics)
+}
+
+// queryLabels returns the query parameters of the request as labels.
+func queryLabels(c *fiber.Ctx) Labels {
+	labels := Labels{}
+	c.Context().QueryArgs().VisitAll(func(k, v []byte) {
+		labels[string(k)] = string(v)
+	})
+	return labels
+}
+
+// errorStatus returns the HTTP status encoded in the first three digits of the error code and the error message.
+func errorStatus(err error) (int, string) {
+	if e, ok := err.(*fiber.Error); ok {
+		return e.Code / 1000, fmt.Sprintf("%d: %s", e.Code, e.Message)
+	}
+	return fiber.StatusInternalServerError, err.Error()
+}
+
+// sendError responds with the HTTP status encoded in the first three digits of the error code.
+func sendError(c *fiber.Ctx, err error) error {
+	status, msg := errorStatus(err)
+	return c.Status(status).SendString(msg)
+}
+
+// seen marks the client of the request as active.
+func (srv *Server) seen(c *fiber.Ctx) {
+	rip := c.Context().RemoteIP().String()
+	srv.lock.Lock()
+	srv.clientsLastSeen[rip] = time.Now()
+	srv.lock.Unlock()
 }
 
 func (srv *Server) initMiddlewares() {
-	srv.api.Use(idempotency.New())
+	// a panicking handler fails its request instead of the server
+	srv.api.Use(recover.New())
+	// clients with a known certificate don't need an API key
+	srv.api.Use(func(c *fiber.Ctx) error {
+		if k := srv.certificateKey(c.Context().TLSConnectionState()); k != nil {
+			srv.seen(c)
+			c.Locals(localsAPIKey, k)
+		}
+		return c.Next()
+	})
 	srv.api.Use(
 		keyauth.New(keyauth.Config{
+			Next: func(c *fiber.Ctx) bool {
+				_, ok := c.Locals(localsAPIKey).(*APIKey)
+				return ok
+			},
 			KeyLookup: "header:Authorization",
 			Validator: func(ctx *fiber.Ctx, s string) (bool, error) {
 				if s == "" {
 					return false, errMissing
 				}
-				for _, k := range srv.apiKeys {
-					if s == "token "+k {
-						rip := ctx.Context().RemoteIP().String()
-						srv.lock.Lock()
-						srv.clientsLastSeen[rip] = time.Now()
-						srv.lock.Unlock()
-						return true, nil
+				if key, ok := strings.CutPrefix(s, "signature "); ok {
+					k := srv.apiKey(key)
+					if k == nil {
+						return false, errInvalid
+					}
+					if err := srv.verifySignature(ctx, k); err != nil {
+						return false, err
 					}
+					srv.seen(ctx)
+					ctx.Locals(localsAPIKey, k)
+					return true, nil
+				}
+				key, ok := strings.CutPrefix(s, "token ")
+				if !ok {
+					return false, errInvalid
+				}
+				k := srv.apiKey(key)
+				if k == nil {
+					return false, errInvalid
+				}
+				if k.Secret != "" {
+					// the key alone may have been seen by a proxy
+					return false, errSignatureRequired
 				}
-				return false, errInvalid
+				srv.seen(ctx)
+				ctx.Locals(localsAPIKey, k)
+				return true, nil
+			},
+			ErrorHandler: func(c *fiber.Ctx, err error) error {
+				switch err {
+				case errSignature, errSignatureRequired, errSignatureExpired, errNonceReused:
+					return sendError(c, err)
+				}
+				return keyauth.ConfigDefault.ErrorHandler(c, err)
 			},
 		}),
 	)
+	// after the authentication, so responses are neither stored nor returned for unauthorized requests
+	idempotent := idempotency.New(idempotency.Config{
+		Lifetime:          srv.idempotencyTTL,
+		KeyHeader:         headerIdempotencyKey,
+		KeyHeaderValidate: func(string) error { return nil }, // validated before it's scoped, see below
+		Storage:           srv.idempotency,
+	})
+	srv.api.Use(func(c *fiber.Ctx) error {
+		if key := c.Get(headerIdempotencyKey); key != "" {
+			if _, err := uuid.Parse(key); err != nil || len(key) != 36 {
+				return sendError(c, errInvalidIdempotencyKey)
+			}
+			// scoped by the API key, so clients can't get the responses of others
+			if k, ok := c.Locals(localsAPIKey).(*APIKey); ok {
+				c.Request().Header.Set(headerIdempotencyKey, k.idempotencyScope()+"/"+key)
+			}
+		}
+		err := idempotent(c)
+		if err == errNotStored {
+			return nil
+		}
+		return err
+	})
+	srv.api.Use(func(c *fiber.Ctx) error {
+		err := c.Next()
+		if c.Method() != fiber.MethodGet {
+			// with batched durability changes are acknowledged after the group commit synced them
+			srv.state.wait()
+		}
+		if err == nil && c.Response().StatusCode() >= fiber.StatusBadRequest {
+			// only successful responses are kept for retries, failed requests are handled again
+			return errNotStored
+		}
+		return err
+	})
 }
 
 func (srv *Server) initAPI() {
 	// PROMETHEUS handler
 	srv.api.Get("/__metrics", func(c *fiber.Ctx) error {
-		fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())(c.Context())
+		if err := authorize(c, ScopeRead, ""); err != nil {
+			return sendError(c, err)
+		}
+		srv.lock.Lock()
+		reg := srv.registry
+		srv.lock.Unlock()
+		fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))(c.Context())
 		return nil
 	})
 
+	// SNAPSHOTS handlers, registered before the metric handlers so they aren't taken for metric names
+	srv.api.Get("/__snapshots", func(c *fiber.Ctx) error {
+		if err := authorize(c, ScopeRead, ""); err != nil {
+			return sendError(c, err)
+		}
+		snapshots, err := srv.Snapshots()
+		if err != nil {
+			return sendError(c, err)
+		}
+		return c.JSON(snapshots)
+	})
+
+	srv.api.Post("/__snapshots/:name/restore", func(c *fiber.Ctx) error {
+		if err := authorize(c, ScopeAdmin, ""); err != nil {
+			return sendError(c, err)
+		}
+		if err := srv.RestoreSnapshot(c.Params("name")); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// LIST handler
+	srv.api.Get("/__list", func(c *fiber.Ctx) error {
+		// keys with prefixes only see their metrics
+		k, ok := c.Locals(localsAPIKey).(*APIKey)
+		if !ok {
+			return sendError(c, errInvalid)
+		}
+		if !k.Scope.includes(ScopeRead) {
+			return sendError(c, errScope)
+		}
+		list, err := srv.list(ListFilter{
+			Prefix: c.Query("prefix"),
+			Regex:  c.Query("regex"),
+			Offset: c.QueryInt("offset"),
+			Limit:  c.QueryInt("limit"),
+		}, k.covers)
+		if err != nil {
+			return sendError(c, err)
+		}
+		return c.JSON(list)
+	})
+
+	// BATCH handler
+	srv.api.Post("/__batch", func(c *fiber.Ctx) error {
+		items := []BatchItem{}
+		if err := json.Unmarshal(c.Body(), &items); err != nil {
+			return sendError(c, errInvalidBatch)
+		}
+		results, err := srv.batch(items, c.QueryBool("transactional"), func(item BatchItem) error {
+			return authorize(c, batchScope(item), item.Key)
+		})
+		if results == nil {
+			return sendError(c, err)
+		}
+		if err != nil {
+			status, _ := errorStatus(err)
+			c.Status(status)
+		}
+		return c.JSON(results)
+	})
+
+	// EXPORT handler
+	srv.api.Get("/__export", func(c *fiber.Ctx) error {
+		if err := authorize(c, ScopeAdmin, ""); err != nil {
+			return sendError(c, err)
+		}
+		metrics := srv.Export()
+		if c.Query("format") == "yaml" {
+			data, err := marshalState(metrics)
+			if err != nil {
+				return sendError(c, err)
+			}
+			c.Set(fiber.HeaderContentType, "application/yaml")
+			return c.Send(data)
+		}
+		return c.JSON(State{Version: stateVersion, Metrics: metrics})
+	})
+
+	// IMPORT handler
+	srv.api.Post("/__import", func(c *fiber.Ctx) error {
+		if err := authorize(c, ScopeAdmin, ""); err != nil {
+			return sendError(c, err)
+		}
+		mode, ok := parseImportMode(c.Query("mode"))
+		if !ok {
+			return sendError(c, errInvalidImportMode)
+		}
+		state, err := ParseState(c.Body())
+		if err != nil {
+			return sendError(c, invalidImport(err))
+		}
+		if err := srv.Import(state.Metrics, mode); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
 	// CREATE handler
 	srv.api.Post("/:metric", func(c *fiber.Ctx) error {
-		if srv.Create(c.Params("metric"), string(c.Body()), 0.0) {
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
+		}
+		typ, ok := parseMetricType(c.Query("type"))
+		if !ok {
+			return sendError(c, errInvalidType)
+		}
+		buckets, ok := parseBuckets(c.Query("buckets"))
+		if !ok {
+			return sendError(c, errInvalidBuckets)
+		}
+		objectives, ok := parseObjectives(c.Query("objectives"))
+		if !ok {
+			return sendError(c, errInvalidObjectives)
+		}
+		labels := parseLabelNames(c.Query("labels"))
+		var created bool
+		var err error
+		switch typ {
+		case Histogram:
+			created, err = srv.CreateHistogram(c.Params("metric"), string(c.Body()), buckets, labels...)
+		case Summary:
+			created, err = srv.CreateSummary(c.Params("metric"), string(c.Body()), objectives, labels...)
+		default:
+			created, err = srv.Create(c.Params("metric"), string(c.Body()), typ, labels...)
+		}
+		if err != nil {
+			return sendError(c, err)
+		}
+		if created {
 			return c.SendStatus(fiber.StatusCreated)
 		}
 		// if we get here the metric already exists
@@ -179,7 +727,10 @@ func (srv *Server) initAPI() {
 
 	// READ handler
 	srv.api.Get("/:metric", func(c *fiber.Ctx) error {
-		if v, ok := srv.Read(c.Params("metric")); ok {
+		if err := authorize(c, ScopeRead, c.Params("metric")); err != nil {
+			return sendError(c, err)
+		}
+		if v, ok := srv.Read(c.Params("metric"), queryLabels(c)); ok {
 			return c.SendString(fmt.Sprint(v))
 		}
 		return c.SendStatus(fiber.StatusNotFound)
@@ -187,93 +738,188 @@ func (srv *Server) initAPI() {
 
 	// UPDATE handler
 	srv.api.Put("/:metric", func(c *fiber.Ctx) error {
-		if srv.Update(c.Params("metric"), string(c.Body())) {
-			return c.SendStatus(fiber.StatusNoContent)
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
 		}
-		return c.SendStatus(fiber.StatusNotFound)
+		if err := srv.Update(c.Params("metric"), string(c.Body()), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 
 	// INCREMENT handler
 	srv.api.Put("/:metric/inc", func(c *fiber.Ctx) error {
-		if srv.Increment(c.Params("metric")) {
-			return c.SendStatus(fiber.StatusNoContent)
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
 		}
-		// if we get here the metric already exists
-		return c.SendStatus(fiber.StatusOK)
+		if err := srv.Increment(c.Params("metric"), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 
 	// DECREMENT handler
 	srv.api.Put("/:metric/dec", func(c *fiber.Ctx) error {
-		if srv.Decrement(c.Params("metric")) {
-			return c.SendStatus(fiber.StatusNoContent)
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
 		}
-		// if we get here the metric already exists
-		return c.SendStatus(fiber.StatusOK)
+		if err := srv.Decrement(c.Params("metric"), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 
 	// ADD handler
 	srv.api.Put("/:metric/add", func(c *fiber.Ctx) error {
-		if srv.Add(c.Params("metric"), string(c.Body())) {
-			return c.SendStatus(fiber.StatusNoContent)
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
 		}
-		// if we get here the metric already exists
-		return c.SendStatus(fiber.StatusOK)
+		if err := srv.Add(c.Params("metric"), string(c.Body()), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 
 	// SUB handler
 	srv.api.Put("/:metric/sub", func(c *fiber.Ctx) error {
-		if srv.Sub(c.Params("metric"), string(c.Body())) {
-			return c.SendStatus(fiber.StatusNoContent)
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
 		}
-		// if we get here the metric already exists
-		return c.SendStatus(fiber.StatusOK)
+		if err := srv.Sub(c.Params("metric"), string(c.Body()), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// OBSERVE handler
+	srv.api.Put("/:metric/observe", func(c *fiber.Ctx) error {
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
+		}
+		if err := srv.Observe(c.Params("metric"), string(c.Body()), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// DESCRIBE handler
+	srv.api.Patch("/:metric", func(c *fiber.Ctx) error {
+		if err := authorize(c, ScopeWrite, c.Params("metric")); err != nil {
+			return sendError(c, err)
+		}
+		if err := srv.Describe(c.Params("metric"), string(c.Body())); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 
 	// DELETE handler
 	srv.api.Delete("/:metric", func(c *fiber.Ctx) error {
-		if srv.Delete(c.Params("metric")) {
-			return c.SendStatus(fiber.StatusNoContent)
+		if err := authorize(c, ScopeAdmin, c.Params("metric")); err != nil {
+			return sendError(c, err)
 		}
-		return c.SendStatus(fiber.StatusNotFound)
+		if err := srv.Delete(c.Params("metric"), queryLabels(c)); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
 	})
 }
 
-func (srv *Server) AddAPIKey(key string) {
-	for _, k := range srv.apiKeys {
-		if k == key {
-			return
+func (srv *Server) Start(keyFile, certFile string) error {
+	durability, ok := parseDurability(string(srv.durability))
+	if !ok {
+		return fmt.Errorf("unknown durability mode %q", srv.durability)
+	}
+	srv.durability = durability
+	if srv.flushInterval <= 0 || srv.batchInterval <= 0 {
+		return fmt.Errorf("flush and batch intervals must be positive")
+	}
+	if srv.idempotencyTTL <= 0 {
+		return fmt.Errorf("idempotency TTL must be positive")
+	}
+	if srv.signatureWindow <= 0 {
+		return fmt.Errorf("signature window must be positive")
+	}
+	keyFile, certFile, err := generateSelfSignedCertificate("local.nexus", "metric-nexus", keyFile, certFile)
+	if err != nil && err.Error() != "files already exist" {
+		return err
+	}
+	if err := srv.SetCertificate(keyFile, certFile); err != nil {
+		return err
+	}
+	if srv.clientCAFile != "" {
+		if err := srv.SetClientCA(srv.clientCAFile); err != nil {
+			return err
 		}
 	}
-	srv.apiKeys = append(srv.apiKeys, key)
-}
 
-func (srv *Server) Start(keyFile, certFile string) error {
-	err := loadState(srv.stateFile)
+	// from here on the stores are closed again if the server can't be started,
+	// bbolt keeps its files locked while they are open
+	store := srv.store
+	if store == nil {
+		store, err = newStateStore(srv.backend, srv.stateFile, srv.durability, srv.batchInterval, srv.flushInterval)
+		if err != nil {
+			return err
+		}
+	}
+	loaded, err := loadState(store, srv.stateFile, srv.recoverState)
 	if err != nil {
-		return err
+		return errors.Join(err, store.Close())
+	}
+	srv.state.replace(loaded)
+	srv.lock.Lock()
+	for _, mtr := range loaded {
+		if err := srv.restore(mtr); err != nil {
+			srv.lock.Unlock()
+			return errors.Join(err, store.Close())
+		}
 	}
-	for _, mtr := range state.Metrics {
-		srv.Create(mtr.Key, mtr.Description, mtr.Value)
+	srv.lock.Unlock()
+	// compact the changes replayed by the store before persisting new ones
+	srv.state.open(store)
+	if err := srv.state.save(); err != nil {
+		return errors.Join(err, srv.state.close())
 	}
+	idempotency, err := openIdempotencyStore(srv.stateFile + ".idempotency")
+	if err != nil {
+		return errors.Join(fmt.Errorf("idempotency keys could not be opened: %w", err), srv.state.close())
+	}
+	ln, err := net.Listen("tcp", srv.addr)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to listen: %w", err), srv.state.close(), idempotency.Close())
+	}
+	srv.idempotency = idempotency
+	srv.wg.Add(1)
 	go func() {
+		defer srv.wg.Done()
 		for {
-			time.Sleep(time.Minute)
-			_ = saveState(srv.stateFile)
+			// read on every iteration, as they can be changed while the server runs
+			srv.lock.Lock()
+			flushInterval, hourly, daily := srv.flushInterval, srv.hourlySnapshots, srv.dailySnapshots
+			srv.lock.Unlock()
+			select {
+			case <-srv.done:
+				return
+			case <-time.After(flushInterval):
+				_ = srv.state.save()
+				_ = rotateSnapshots(srv.stateFile, srv.state, hourly, daily, time.Now())
+				_ = srv.idempotency.prune(time.Now())
+			}
 		}
 	}()
 
-	srv.api = fiber.New()
+	srv.lock.Lock()
+	// keys, types and label names of requests are kept in the metrics, so they must not point into request buffers
+	srv.api = fiber.New(fiber.Config{Immutable: true})
+	srv.lock.Unlock()
 	srv.initMiddlewares()
 	srv.initAPI()
 
-	keyFile, certFile, err = generateSelfSignedCertificate("local.nexus", "metric-nexus", keyFile, certFile)
-	if err != nil && err.Error() != "files already exist" {
-		return err
-	}
-
+	srv.wg.Add(1)
 	go func() {
-		srv.Create("metric_nexus_clients", "The total number of clients that used MetricNexus within the last hour.", 0)
-		// Indefinitely check when clients were last seen,
+		defer srv.wg.Done()
+		_, _ = srv.Create("metric_nexus_clients", "The total number of clients that used MetricNexus within the last hour.", Gauge)
+		// Until the server shuts down check when clients were last seen,
 		// if it's more than one hour ago we assume they
 		// are inactive and remove them from the activity list.
 		for {
@@ -286,21 +932,283 @@ func (srv *Server) Start(keyFile, certFile string) error {
 			}
 			activeClients := len(srv.clientsLastSeen)
 			srv.lock.Unlock()
-			srv.Update("metric_nexus_clients", activeClients)
-			time.Sleep(1 * time.Minute)
+			_ = srv.Update("metric_nexus_clients", activeClients)
+			select {
+			case <-srv.done:
+				return
+			case <-time.After(time.Minute):
+			}
 		}
 	}()
 
-	return srv.api.ListenTLS(srv.addr, certFile, keyFile)
+	return srv.api.Listener(tls.NewListener(ln, &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     srv.getCertificate,
+		GetConfigForClient: srv.tlsConfig,
+	}))
+}
+
+// SetCertificate replaces the TLS certificate, e.g. after it was renewed.
+// New connections use it, established ones keep the previous certificate.
+func (srv *Server) SetCertificate(keyFile, certFile string) error {
+	cert, err := loadCertificate(keyFile, certFile)
+	if err != nil {
+		return err
+	}
+	srv.certLock.Lock()
+	defer srv.certLock.Unlock()
+	srv.cert = cert
+	return nil
+}
+
+func loadCertificate(keyFile, certFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: cannot load TLS key pair from certFile=%q and keyFile=%q: %w", certFile, keyFile, err)
+	}
+	return &cert, nil
+}
+
+func (srv *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	srv.certLock.RLock()
+	defer srv.certLock.RUnlock()
+	return srv.cert, nil
+}
+
+// SetSnapshots changes the number of hourly and daily snapshots to keep while the server runs, see WithSnapshots.
+func (srv *Server) SetSnapshots(hourly, daily int) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.hourlySnapshots = hourly
+	srv.dailySnapshots = daily
+}
+
+// SetFlushInterval changes how often the state is saved while the server runs, see WithFlushInterval.
+// It takes effect after the current interval, the group commits of interval durability keep their interval.
+func (srv *Server) SetFlushInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("flush interval must be positive")
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.flushInterval = d
+	return nil
+}
+
+// RuntimeConfig are the settings that can be changed while the server runs, see Server.Reload.
+type RuntimeConfig struct {
+	APIKeys         []APIKey
+	ClientCerts     []ClientCertificate
+	ClientCAFile    string // "" keeps the current client CA
+	KeyFile         string // "" keeps the current TLS certificate
+	CertFile        string
+	FlushInterval   time.Duration
+	HourlySnapshots int
+	DailySnapshots  int
+}
+
+// Reload replaces the keys, client certificates, client CA, TLS certificate, flush interval and snapshot
+// retention at once, e.g. after the configuration was reloaded. Everything is validated and the files
+// are read first, nothing is changed if one of them is invalid.
+func (srv *Server) Reload(rc RuntimeConfig) error {
+	apiKeys, err := newAPIKeys(rc.APIKeys)
+	if err != nil {
+		return err
+	}
+	clientCerts, err := newClientCertificates(rc.ClientCerts)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if rc.ClientCAFile != "" {
+		if pool, err = loadClientCA(rc.ClientCAFile); err != nil {
+			return err
+		}
+	}
+	var cert *tls.Certificate
+	if rc.KeyFile != "" && rc.CertFile != "" {
+		if cert, err = loadCertificate(rc.KeyFile, rc.CertFile); err != nil {
+			return err
+		}
+	}
+	if rc.FlushInterval <= 0 {
+		return fmt.Errorf("flush interval must be positive")
+	}
+
+	// the locks are never held at the same time elsewhere, so this order can't deadlock
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.keysLock.Lock()
+	defer srv.keysLock.Unlock()
+	srv.certLock.Lock()
+	defer srv.certLock.Unlock()
+	srv.setAPIKeys(apiKeys)
+	srv.clientCerts = clientCerts
+	if pool != nil {
+		srv.clientCAs = pool
+	}
+	if cert != nil {
+		srv.cert = cert
+	}
+	srv.flushInterval = rc.FlushInterval
+	srv.hourlySnapshots = rc.HourlySnapshots
+	srv.dailySnapshots = rc.DailySnapshots
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones to finish or the context to expire.
+// Afterwards it stops the background loops and writes a final snapshot of the state.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.lock.Lock()
+	api := srv.api
+	select {
+	case <-srv.done:
+		srv.lock.Unlock()
+		return errors.New("server is already shut down")
+	default:
+		close(srv.done)
+	}
+	srv.lock.Unlock()
+
+	var errs []error
+	if api != nil {
+		if err := api.ShutdownWithContext(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	srv.wg.Wait()
+	if err := srv.state.save(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := srv.state.close(); err != nil {
+		errs = append(errs, err)
+	}
+	if srv.idempotency != nil {
+		if err := srv.idempotency.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ServerOption configures optional behaviour of a Server.
+type ServerOption func(srv *Server)
+
+// WithRuntimeMetrics additionally exposes the Go runtime and process metrics of the server.
+func WithRuntimeMetrics() ServerOption {
+	return func(srv *Server) {
+		srv.collectors = append(srv.collectors,
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+		srv.registry.MustRegister(srv.collectors...)
+	}
 }
 
-func NewServer(host string, port int, stateFile string) *Server {
+// WithStateRecovery makes the server start from the newest snapshot that can be parsed
+// if the state file is corrupt, instead of refusing to start.
+func WithStateRecovery() ServerOption {
+	return func(srv *Server) {
+		srv.recoverState = true
+	}
+}
+
+// WithSnapshots sets how many hourly and daily snapshots of the state are kept
+// next to the state file, zero disables the kind. The default is 24 hourly and 7 daily snapshots.
+func WithSnapshots(hourly, daily int) ServerOption {
+	return func(srv *Server) {
+		srv.hourlySnapshots = hourly
+		srv.dailySnapshots = daily
+	}
+}
+
+// WithFlushInterval sets how often a snapshot of the state is written to the state file, the default is one minute.
+func WithFlushInterval(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.flushInterval = d
+	}
+}
+
+// WithDurability sets when changes are synced to disk, the default is DurabilityOnWrite.
+// The batch interval is the time between group commits of DurabilityBatched.
+func WithDurability(mode Durability, batchInterval time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.durability = mode
+		if batchInterval > 0 {
+			srv.batchInterval = batchInterval
+		}
+	}
+}
+
+// WithStateBackend selects the built-in store the state is persisted with, the default is BackendYAML.
+func WithStateBackend(backend StateBackend) ServerOption {
+	return func(srv *Server) {
+		srv.backend = backend
+	}
+}
+
+// WithIdempotencyTTL sets how long the response to a request with an X-Idempotency-Key header is
+// kept to answer retries of the request, default 24 hours. The responses survive restarts.
+func WithIdempotencyTTL(ttl time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.idempotencyTTL = ttl
+	}
+}
+
+// WithSignatureWindow sets how far the timestamp of a signed request may be off the time of the server,
+// default 5 minutes. Nonces are remembered for that long, so requests can't be replayed within it.
+func WithSignatureWindow(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.signatureWindow = d
+	}
+}
+
+// WithClientCA makes the server verify client certificates with the CA in the given PEM file. Clients whose
+// certificate is signed by it and known by name, see AddClientCertificate, authenticate without an API key.
+// If required, connections without a valid client certificate are refused, otherwise clients can still
+// authenticate with an API key instead.
+func WithClientCA(caFile string, required bool) ServerOption {
+	return func(srv *Server) {
+		srv.clientCAFile = caFile
+		srv.clientCARequired = required
+	}
+}
+
+// WithStateStore persists the state with a custom store. The durability options
+// only apply to the built-in stores, snapshots are still written next to the state file.
+func WithStateStore(store StateStore) ServerOption {
+	return func(srv *Server) {
+		srv.store = store
+	}
+}
+
+func NewServer(host string, port int, stateFile string, opts ...ServerOption) *Server {
 	srv := &Server{
 		addr:            fmt.Sprintf("%s:%d", host, port),
 		stateFile:       stateFile,
+		registry:        prometheus.NewRegistry(),
+		state:           &State{},
+		hourlySnapshots: 24,
+		dailySnapshots:  7,
+		flushInterval:   time.Minute,
+		durability:      DurabilityOnWrite,
+		backend:         BackendYAML,
+		batchInterval:   10 * time.Millisecond,
+		idempotencyTTL:  24 * time.Hour,
+		signatureWindow: 5 * time.Minute,
+		nonces:          newNonceCache(),
 		lock:            &sync.Mutex{},
+		keysLock:        &sync.RWMutex{},
+		keyCache:        newKeyCache(),
+		clientCerts:     map[string]*APIKey{},
+		certLock:        &sync.RWMutex{},
+		wg:              &sync.WaitGroup{},
+		done:            make(chan struct{}),
 		data:            map[string]*metric{},
 		clientsLastSeen: map[string]time.Time{},
 	}
+	for _, opt := range opts {
+		opt(srv)
+	}
 	return srv
 }
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartFailureReleasesStores(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	srv := NewServer("127.0.0.1", port, filepath.Join(dir, "state"), WithStateBackend(BackendBolt))
+	keyFile, certFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem")
+	if err := srv.Start(keyFile, certFile); err == nil || !strings.Contains(err.Error(), "failed to listen") {
+		t.Fatalf("expected the listen error, got %v", err)
+	}
+	ln.Close()
+
+	// the bolt files are unlocked, a retry doesn't wait for them
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Start(keyFile, certFile)
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-errs:
+			t.Fatalf("server could not be started again: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening, the stores of the failed start are still locked")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Headers of signed requests, the Authorization header is "signature <key>".
+const (
+	headerSignature          = "X-Signature"
+	headerSignatureTimestamp = "X-Signature-Timestamp" // Unix seconds
+	headerSignatureNonce     = "X-Signature-Nonce"
+	maxNonceLength           = 128
+)
+
+// signature returns the hex encoded HMAC-SHA256 of the request with the secret. It covers the method,
+// the request URI with the query, the timestamp, the nonce and the SHA-256 of the body.
+func signature(secret, method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, uri, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers the nonces of signed requests until their timestamps leave the signature window.
+type nonceCache struct {
+	lock   *sync.Mutex
+	nonces map[string]time.Time // expiry by nonce
+	pruned time.Time
+}
+
+// use records the nonce until the given time and returns false if it was already used.
+func (nc *nonceCache) use(nonce string, until, now time.Time) bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if now.Sub(nc.pruned) >= time.Minute {
+		for n, expiry := range nc.nonces {
+			if now.After(expiry) {
+				delete(nc.nonces, n)
+			}
+		}
+		nc.pruned = now
+	}
+	if expiry, ok := nc.nonces[nonce]; ok && !now.After(expiry) {
+		return false
+	}
+	nc.nonces[nonce] = until
+	return true
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{lock: &sync.Mutex{}, nonces: map[string]time.Time{}}
+}
+
+// verifySignature returns an error unless the request is signed with the secret of the key, its timestamp
+// is within the signature window and its nonce wasn't used before.
+func (srv *Server) verifySignature(c *fiber.Ctx, k *APIKey) error {
+	if k.Secret == "" {
+		return errSignature
+	}
+	timestamp, nonce, sig := c.Get(headerSignatureTimestamp), c.Get(headerSignatureNonce), c.Get(headerSignature)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > maxNonceLength {
+		return errSignature
+	}
+	expected := signature(k.Secret, c.Method(), string(c.Context().RequestURI()), timestamp, nonce, c.Body())
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errSignature
+	}
+	now, t := time.Now(), time.Unix(ts, 0)
+	if t.Before(now.Add(-srv.signatureWindow)) || t.After(now.Add(srv.signatureWindow)) {
+		return errSignatureExpired
+	}
+	// a nonce is only recorded for valid signatures, so others can't fill the cache
+	if !srv.nonces.use(k.id()+"/"+nonce, t.Add(srv.signatureWindow), now) {
+		return errNonceReused
+	}
+	return nil
+}
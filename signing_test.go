@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedGet sends a GET request for the URI signed with the secret of the key and returns its status and body.
+func signedGet(t *testing.T, port int, key, secret, uri string, timestamp time.Time, nonce string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "https://127.0.0.1:"+strconv.Itoa(port)+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	req.Header.Set("Authorization", "signature "+key)
+	req.Header.Set(headerSignatureTimestamp, ts)
+	req.Header.Set(headerSignatureNonce, nonce)
+	req.Header.Set(headerSignature, signature(secret, http.MethodGet, uri, ts, nonce, nil))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// checkRejected fails the test unless the request was rejected with the error code.
+func checkRejected(t *testing.T, what string, status int, body string, code int) {
+	t.Helper()
+	if status != code/1000 || !strings.HasPrefix(body, strconv.Itoa(code)+":") {
+		t.Errorf("%s: expected error %d, got %d %q", what, code, status, body)
+	}
+}
+
+func TestSignatureExpiry(t *testing.T) {
+	_, port := startServer(t, []ServerOption{WithSignatureWindow(time.Minute)},
+		APIKey{Key: "signer", Secret: "secret", Scope: ScopeRead})
+	c := NewClient("127.0.0.1", port, "key", true)
+	if err := c.Create("g", "gauge", Gauge); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if status, body := signedGet(t, port, "signer", "secret", "/g", now, "a"); status != http.StatusOK {
+		t.Errorf("current request was rejected: %d %q", status, body)
+	}
+	status, body := signedGet(t, port, "signer", "secret", "/g", now.Add(-2*time.Minute), "b")
+	checkRejected(t, "old request", status, body, errSignatureExpired.Code)
+	status, body = signedGet(t, port, "signer", "secret", "/g", now.Add(2*time.Minute), "c")
+	checkRejected(t, "future request", status, body, errSignatureExpired.Code)
+	status, body = signedGet(t, port, "signer", "other", "/g", now, "d")
+	checkRejected(t, "request with a wrong secret", status, body, errSignature.Code)
+}
+
+func TestSignatureNonceReplay(t *testing.T) {
+	_, port := startServer(t, nil,
+		APIKey{Key: "signer", Secret: "secret", Scope: ScopeRead},
+		APIKey{Key: "other", Secret: "secret", Scope: ScopeRead})
+	c := NewClient("127.0.0.1", port, "key", true)
+	if err := c.Create("g", "gauge", Gauge); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if status, body := signedGet(t, port, "signer", "secret", "/g", now, "n1"); status != http.StatusOK {
+		t.Fatalf("first request was rejected: %d %q", status, body)
+	}
+	status, body := signedGet(t, port, "signer", "secret", "/g", now, "n1")
+	checkRejected(t, "replayed request", status, body, errNonceReused.Code)
+	status, body = signedGet(t, port, "signer", "secret", "/g?host=a", now, "n1")
+	checkRejected(t, "other request with a used nonce", status, body, errNonceReused.Code)
+	if status, body := signedGet(t, port, "signer", "secret", "/g", now, "n2"); status != http.StatusOK {
+		t.Errorf("request with a new nonce was rejected: %d %q", status, body)
+	}
+	if status, body := signedGet(t, port, "other", "secret", "/g", now, "n1"); status != http.StatusOK {
+		t.Errorf("nonce of another key was rejected: %d %q", status, body)
+	}
+
+	// nonces of requests with invalid signatures aren't recorded
+	status, body = signedGet(t, port, "signer", "wrong", "/g", now, "n3")
+	checkRejected(t, "request with a wrong secret", status, body, errSignature.Code)
+	if status, body := signedGet(t, port, "signer", "secret", "/g", now, "n3"); status != http.StatusOK {
+		t.Errorf("nonce of an invalid request was recorded: %d %q", status, body)
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	nc := newNonceCache()
+	now := time.Now()
+	if !nc.use("n", now.Add(time.Minute), now) {
+		t.Fatal("new nonce was rejected")
+	}
+	if nc.use("n", now.Add(2*time.Minute), now.Add(30*time.Second)) {
+		t.Error("nonce was accepted twice within its window")
+	}
+	if !nc.use("n", now.Add(3*time.Minute), now.Add(2*time.Minute)) {
+		t.Error("nonce was rejected after its window")
+	}
+	nc.use("m", now.Add(3*time.Minute), now.Add(5*time.Minute))
+	if _, ok := nc.nonces["n"]; ok {
+		t.Error("expired nonce was not pruned")
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotHourly = "hourly"
+	snapshotDaily  = "daily"
+)
+
+// Snapshot is a copy of the state kept next to the state file.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"-"`
+	Created time.Time `json:"created"`
+}
+
+func snapshotPrefix(stateFile string) string {
+	return stateFile + ".snapshot-"
+}
+
+// snapshotName returns the name of the snapshot of the given kind that covers the given time.
+func snapshotName(kind string, t time.Time) string {
+	if kind == snapshotDaily {
+		return kind + "-" + t.UTC().Format("20060102")
+	}
+	return kind + "-" + t.UTC().Format("20060102-15")
+}
+
+// validSnapshotName makes sure the name can't be used to access files outside of the snapshots.
+func validSnapshotName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
+}
+
+// listSnapshots returns the snapshots of the given state file, newest first.
+func listSnapshots(stateFile string) ([]Snapshot, error) {
+	paths, err := filepath.Glob(snapshotPrefix(stateFile) + "*")
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, p := range paths {
+		if strings.Contains(filepath.Base(p), ".tmp-") {
+			continue // incomplete write
+		}
+		fi, err := os.Stat(p)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name:    strings.TrimPrefix(p, snapshotPrefix(stateFile)),
+			Path:    p,
+			Created: fi.ModTime(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// readSnapshot parses the snapshot with the given name.
+func readSnapshot(stateFile, name string) (*State, error) {
+	if !validSnapshotName(name) {
+		return nil, errSnapshotNotFound
+	}
+	data, err := os.ReadFile(snapshotPrefix(stateFile) + name)
+	if os.IsNotExist(err) {
+		return nil, errSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := parseYAMLState(data)
+	if err != nil {
+		return nil, err
+	}
+	return &State{Metrics: metrics}, nil
+}
+
+// rotateSnapshots writes the hourly and daily snapshots that are due and removes
+// the oldest ones exceeding the retention. A retention of zero disables the kind.
+func rotateSnapshots(stateFile string, state *State, hourly, daily int, now time.Time) error {
+	due := []string{}
+	for kind, retention := range map[string]int{snapshotHourly: hourly, snapshotDaily: daily} {
+		if retention > 0 && !fileExists(snapshotPrefix(stateFile)+snapshotName(kind, now)) {
+			due = append(due, kind)
+		}
+	}
+	if len(due) > 0 {
+		// the state is only locked to copy the metrics, not while they are marshalled
+		data, err := marshalState(state.copyMetrics())
+		if err != nil {
+			return err
+		}
+		for _, kind := range due {
+			if err := writeFileAtomic(snapshotPrefix(stateFile)+snapshotName(kind, now), data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	for kind, retention := range map[string]int{snapshotHourly: hourly, snapshotDaily: daily} {
+		if retention <= 0 {
+			continue
+		}
+		if err := pruneSnapshots(stateFile, kind, retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneSnapshots removes the oldest snapshots of the given kind until only retention snapshots are left.
+func pruneSnapshots(stateFile, kind string, retention int) error {
+	paths, err := filepath.Glob(snapshotPrefix(stateFile) + kind + "-*")
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, p := range paths {
+		if !strings.Contains(filepath.Base(p), ".tmp-") {
+			names = append(names, p)
+		}
+	}
+	// the timestamps in the names sort chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for i := retention; i < len(names); i++ {
+		if err := os.Remove(names[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// spoolRetryInterval is the time between attempts to replay the spooled changes.
+const spoolRetryInterval = time.Second
+
+// SpoolOverflow decides what happens to changes that don't fit into a full spool.
+type SpoolOverflow string
+
+const (
+	SpoolDropOldest SpoolOverflow = "drop-oldest" // discards the oldest spooled changes to make room
+	SpoolDropNewest SpoolOverflow = "drop-newest" // discards the new changes and returns the error of their request
+)
+
+// spool keeps changes the server could not accept in a file and replays them in order once the server is
+// available again. The changes are kept in batches with the idempotency key of their request, one JSON line
+// per batch, so a replay after a lost response or a restart is applied only once by the server.
+type spool struct {
+	client     *Client
+	file       string
+	size       int
+	overflow   SpoolOverflow
+	lock       *sync.Mutex
+	replayLock *sync.Mutex // keeps replays in order
+	batches    []*spoolBatch
+	items      int   // number of spooled items in all batches
+	err        error // error of the last replay that couldn't be returned
+	done       chan struct{}
+	stopped    chan struct{}
+	closeOnce  *sync.Once
+}
+
+// spoolBatch is a batch of spooled changes, it's always sent with the same items and idempotency key.
+// The file has one line per batch and consecutive lines with the same key when items were appended
+// to a batch that wasn't sent yet.
+type spoolBatch struct {
+	ID    string      `json:"id"` // idempotency key
+	Items []BatchItem `json:"changes"`
+	sent  bool        // whether the batch may have reached the server, no items can be appended anymore
+}
+
+// load reads the batches spooled by a previous client. As they may have reached the server, they are
+// only replayed as they are.
+func (s *spool) load() error {
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		b := &spoolBatch{}
+		err := json.Unmarshal(line, b)
+		if err == nil && b.ID == "" {
+			err = errors.New("batch without idempotency key")
+		}
+		if err != nil {
+			if i == len(lines)-1 {
+				break // the last line was torn by a crash during the write
+			}
+			return fmt.Errorf("spool %s, line %d: %w", s.file, i+1, err)
+		}
+		if n := len(s.batches); n > 0 && s.batches[n-1].ID == b.ID {
+			s.batches[n-1].Items = append(s.batches[n-1].Items, b.Items...)
+		} else {
+			b.sent = true
+			s.batches = append(s.batches, b)
+		}
+		s.items += len(b.Items)
+	}
+	return nil
+}
+
+// pending returns whether there are spooled items.
+func (s *spool) pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.items > 0
+}
+
+// push spools the items that could not be sent because of the given error. If they were sent with an
+// idempotency key, they are kept as a batch with that key, otherwise they are appended to the last batch
+// if it wasn't sent yet.
+func (s *spool) push(items []BatchItem, id string, cause error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.items+len(items) > s.size {
+		if s.overflow != SpoolDropOldest {
+			return fmt.Errorf("spool is full: %w", cause)
+		}
+		if len(items) > s.size {
+			items = items[len(items)-s.size:]
+		}
+		s.drop(s.items + len(items) - s.size)
+		s.add(items, id)
+		return s.write()
+	}
+	b := s.add(items, id)
+	if err := s.append(&spoolBatch{ID: b.ID, Items: items}); err != nil {
+		return errors.Join(cause, err)
+	}
+	return nil
+}
+
+// add adds the items to the batches and returns the batch they were added to, the caller must hold the lock.
+func (s *spool) add(items []BatchItem, id string) *spoolBatch {
+	s.items += len(items)
+	if n := len(s.batches); id == "" && n > 0 && !s.batches[n-1].sent && len(s.batches[n-1].Items)+len(items) <= maxBatchItems {
+		b := s.batches[n-1]
+		b.Items = append(b.Items, items...)
+		return b
+	}
+	b := &spoolBatch{ID: id, Items: items, sent: id != ""}
+	if id == "" {
+		b.ID = uuid.NewString()
+	}
+	s.batches = append(s.batches, b)
+	return b
+}
+
+// drop discards the given number of the oldest items, the caller must hold the lock.
+// A batch that loses some of its items keeps its key, a replay of it is still applied only once.
+func (s *spool) drop(n int) {
+	s.items -= n
+	for n > 0 {
+		b := s.batches[0]
+		if len(b.Items) > n {
+			b.Items = b.Items[n:]
+			return
+		}
+		n -= len(b.Items)
+		s.batches = s.batches[1:]
+	}
+}
+
+// append appends the batch to the file, the caller must hold the lock.
+func (s *spool) append(b *spoolBatch) error {
+	data, err := marshalSpool([]*spoolBatch{b})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// write replaces the file with the spooled batches, the caller must hold the lock.
+func (s *spool) write() error {
+	data, err := marshalSpool(s.batches)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data, 0644)
+}
+
+// replay sends the spooled batches in order with their idempotency keys until the spool is empty or the
+// server is unavailable. Items the server rejects are dropped, as retrying them can't succeed.
+func (s *spool) replay(ctx context.Context) error {
+	s.replayLock.Lock()
+	defer s.replayLock.Unlock()
+	errs := []error{}
+	for {
+		s.lock.Lock()
+		if len(s.batches) == 0 {
+			s.lock.Unlock()
+			return errors.Join(errs...)
+		}
+		b := s.batches[0]
+		b.sent = true
+		items := append([]BatchItem{}, b.Items...)
+		s.lock.Unlock()
+
+		_, err := s.client.commitWithKey(ctx, items, false, b.ID)
+		var unavailable *unavailableError
+		if errors.As(err, &unavailable) {
+			return errors.Join(append(errs, fmt.Errorf("%d changes remain spooled: %w", s.len(), err))...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		s.lock.Lock()
+		// the batch is gone if it was dropped in the meantime
+		if len(s.batches) > 0 && s.batches[0] == b {
+			s.batches = s.batches[1:]
+			s.items -= len(b.Items)
+		}
+		err = s.write()
+		s.lock.Unlock()
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+}
+
+func (s *spool) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.items
+}
+
+// run replays the spooled items every retry interval until the spool is closed.
+func (s *spool) run() {
+	defer close(s.stopped)
+	t := time.NewTicker(spoolRetryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			if !s.pending() {
+				continue
+			}
+			if err := s.replay(context.Background()); err != nil {
+				var unavailable *unavailableError
+				if errors.As(err, &unavailable) {
+					continue // expected until the server is back
+				}
+				s.lock.Lock()
+				s.err = err
+				s.lock.Unlock()
+			}
+		}
+	}
+}
+
+// lastError returns and clears the error of the last replay that couldn't be returned.
+func (s *spool) lastError() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// close stops the periodic replays and replays the spooled items once more.
+// Items that can't be replayed stay in the file for the next client.
+func (s *spool) close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		<-s.stopped
+	})
+	return s.replay(context.Background())
+}
+
+func marshalSpool(batches []*spoolBatch) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, b := range batches {
+		line, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// spooled sends a change with the given function. If the client has a spool, the change is sent as a batch
+// instead and that batch is spooled if the server is unavailable, so its replay has the idempotency key of
+// the first attempt. While earlier changes are spooled, the change is spooled without an attempt so the
+// order is kept.
+func (c *Client) spooled(ctx context.Context, item BatchItem, send func() error) error {
+	return c.spooledBatch(ctx, []BatchItem{item}, send)
+}
+
+func (c *Client) spooledBatch(ctx context.Context, items []BatchItem, send func() error) error {
+	if c.spool == nil {
+		return send()
+	}
+	if c.spool.pending() {
+		return c.spool.push(items, "", errors.New("earlier changes are still spooled"))
+	}
+	id := uuid.NewString()
+	_, err := c.commitWithKey(ctx, items, false, id)
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		return c.spool.push(items, id, err)
+	}
+	return err
+}
+
+func newSpool(c *Client, file string, size int, overflow SpoolOverflow) *spool {
+	s := &spool{
+		client:     c,
+		file:       file,
+		size:       size,
+		overflow:   overflow,
+		lock:       &sync.Mutex{},
+		replayLock: &sync.Mutex{},
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		closeOnce:  &sync.Once{},
+	}
+	s.err = s.load()
+	go s.run()
+	return s
+}
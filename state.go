@@ -2,83 +2,374 @@ package metrics
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
-
-	"gopkg.in/yaml.v3"
-)
-
-var (
-	state *State
+	"time"
 )
 
 //go:embed state.yaml
 var stateDefault string
 
+type StateSeries struct {
+	Labels       Labels    `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Value        float64   `yaml:"value" json:"value"`
+	Count        uint64    `yaml:"count,omitempty" json:"count,omitempty"`
+	Sum          float64   `yaml:"sum,omitempty" json:"sum,omitempty"`
+	BucketCounts []uint64  `yaml:"bucket_counts,omitempty" json:"bucket_counts,omitempty"`
+	Samples      []float64 `yaml:"samples,omitempty" json:"samples,omitempty"`
+	Updated      time.Time `yaml:"updated,omitempty" json:"updated,omitempty"`
+}
+
+// id identifies the series by its label values in the order of the given label names.
+func (ss StateSeries) id(names []string) string {
+	values := make([]string, len(names))
+	for i, n := range names {
+		values[i] = ss.Labels[n]
+	}
+	return seriesID(values)
+}
+
 type StateMetric struct {
-	Key         string  `yaml:"key"`
-	Description string  `yaml:"description"`
-	Value       float64 `yaml:"value"`
+	Key         string              `yaml:"key" json:"key"`
+	Description string              `yaml:"description" json:"description"`
+	Type        MetricType          `yaml:"type" json:"type"`
+	Labels      []string            `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Buckets     []float64           `yaml:"buckets,omitempty" json:"buckets,omitempty"`
+	Objectives  map[float64]float64 `yaml:"objectives,omitempty" json:"objectives,omitempty"`
+	Series      []StateSeries       `yaml:"series" json:"series"`
+}
+
+// MutationOp is the kind of change a Mutation applies to the state.
+type MutationOp string
+
+const (
+	MutationPut          MutationOp = "put"           // replaces or appends a metric
+	MutationDescribe     MutationOp = "describe"      // changes the description of a metric
+	MutationRemove       MutationOp = "remove"        // removes a metric
+	MutationPutSeries    MutationOp = "put_series"    // replaces or appends a series of a metric
+	MutationRemoveSeries MutationOp = "remove_series" // removes a series of a metric
+	MutationBatch        MutationOp = "batch"         // applies the mutations of a transactional batch at once
+)
+
+// Mutation is a change of the state. Mutations carry the resulting values rather
+// than deltas, so applying the same mutation twice leaves the state unchanged.
+type Mutation struct {
+	Op          MutationOp   `yaml:"op" json:"op"`
+	Key         string       `yaml:"key" json:"key"`
+	Description string       `yaml:"description,omitempty" json:"description,omitempty"`
+	Metric      *StateMetric `yaml:"metric,omitempty" json:"metric,omitempty"`
+	Names       []string     `yaml:"names,omitempty" json:"names,omitempty"`         // label names of the metric
+	Series      *StateSeries `yaml:"series,omitempty" json:"series,omitempty"`       // series to put
+	Values      []string     `yaml:"values,omitempty" json:"values,omitempty"`       // label values of the series to remove
+	Mutations   []Mutation   `yaml:"mutations,omitempty" json:"mutations,omitempty"` // of a batch
 }
 
 type State struct {
 	lock    *sync.Mutex
-	Metrics []StateMetric `yaml:"metrics"`
+	store   StateStore
+	tx      []Mutation              // mutations of the open transaction, nil if there is none
+	index   map[string]*metricIndex // positions of the metrics by key, built on first use
+	Version int                     `yaml:"version" json:"version"`
+	Metrics []StateMetric           `yaml:"metrics" json:"metrics"`
 }
 
-func (s *State) Append(k, d string, v float64) {
+// metricIndex is the position of a metric in the state and those of its series by id,
+// so mutations don't have to search them.
+type metricIndex struct {
+	pos    int
+	series map[string]int
+}
+
+func newMetricIndex(pos int, mtr StateMetric) *metricIndex {
+	mi := &metricIndex{pos: pos, series: make(map[string]int, len(mtr.Series))}
+	for j, sers := range mtr.Series {
+		if _, ok := mi.series[sers.id(mtr.Labels)]; !ok {
+			mi.series[sers.id(mtr.Labels)] = j
+		}
+	}
+	return mi
+}
+
+// indexLocked returns the index of the metrics, the caller must hold the lock.
+func (s *State) indexLocked() map[string]*metricIndex {
+	if s.index == nil {
+		s.index = make(map[string]*metricIndex, len(s.Metrics))
+		for i, mtr := range s.Metrics {
+			if _, ok := s.index[mtr.Key]; !ok {
+				s.index[mtr.Key] = newMetricIndex(i, mtr)
+			}
+		}
+	}
+	return s.index
+}
+
+func (s *State) init() {
 	if s.lock == nil {
 		s.lock = &sync.Mutex{}
 	}
+}
+
+// apply persists the mutation with the store, if there is one, and applies it.
+// During a transaction it's only applied and persisted by the commit.
+func (s *State) apply(mut Mutation) error {
+	s.init()
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.Metrics = append(s.Metrics, StateMetric{
-		Key:         k,
-		Description: d,
-		Value:       v,
-	})
+	if s.tx != nil {
+		s.tx = append(s.tx, mut)
+		s.applyLocked(mut)
+		return nil
+	}
+	if s.store != nil {
+		if err := s.store.Apply(mut); err != nil {
+			return errPersistence
+		}
+	}
+	s.applyLocked(mut)
+	return nil
 }
 
-func (s *State) SetValue(k string, v float64) bool {
-	if s.lock == nil {
-		s.lock = &sync.Mutex{}
+// begin starts a transaction, all further mutations are persisted together by commit or not at all.
+// The caller must make sure no other mutations are applied until the transaction ends.
+func (s *State) begin() {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tx = []Mutation{}
+}
+
+// commit persists the mutations of the transaction as a single batch mutation, so a crash can't
+// persist only some of them. If that fails, nothing was persisted and the caller has to undo them.
+func (s *State) commit() error {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	muts := s.tx
+	s.tx = nil
+	if s.store == nil || len(muts) == 0 {
+		return nil
 	}
+	if err := s.store.Apply(Mutation{Op: MutationBatch, Mutations: muts}); err != nil {
+		return errPersistence
+	}
+	return nil
+}
+
+// discard ends the transaction without persisting its mutations, e.g. after they were undone.
+func (s *State) discard() {
+	s.init()
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	for i, mtr := range s.Metrics {
-		if mtr.Key == k {
-			s.Metrics[i].Value = v
-			return true
+	s.tx = nil
+}
+
+// applyLocked applies the mutation, the caller must hold the lock.
+func (s *State) applyLocked(mut Mutation) {
+	if mut.Op == MutationBatch {
+		for _, m := range mut.Mutations {
+			s.applyLocked(m)
+		}
+		return
+	}
+	index := s.indexLocked()
+	mi := index[mut.Key]
+	switch mut.Op {
+	case MutationPut:
+		if mi == nil {
+			s.Metrics = append(s.Metrics, *mut.Metric)
+			index[mut.Key] = newMetricIndex(len(s.Metrics)-1, *mut.Metric)
+			return
+		}
+		s.Metrics[mi.pos] = *mut.Metric
+		index[mut.Key] = newMetricIndex(mi.pos, *mut.Metric)
+	case MutationDescribe:
+		if mi != nil {
+			s.Metrics[mi.pos].Description = mut.Description
+		}
+	case MutationRemove:
+		if mi == nil {
+			return
+		}
+		s.Metrics = append(s.Metrics[:mi.pos], s.Metrics[mi.pos+1:]...)
+		delete(index, mut.Key)
+		for i := mi.pos; i < len(s.Metrics); i++ {
+			if other := index[s.Metrics[i].Key]; other != nil && other.pos == i+1 {
+				other.pos = i
+			}
+		}
+	case MutationPutSeries:
+		if mi == nil {
+			return
+		}
+		mtr := &s.Metrics[mi.pos]
+		id := mut.Series.id(mut.Names)
+		if j, ok := mi.series[id]; ok {
+			mtr.Series[j] = *mut.Series
+			return
+		}
+		mtr.Series = append(mtr.Series, *mut.Series)
+		mi.series[id] = len(mtr.Series) - 1
+	case MutationRemoveSeries:
+		if mi == nil {
+			return
+		}
+		mtr := &s.Metrics[mi.pos]
+		id := seriesID(mut.Values)
+		j, ok := mi.series[id]
+		if !ok {
+			return
+		}
+		mtr.Series = append(mtr.Series[:j], mtr.Series[j+1:]...)
+		delete(mi.series, id)
+		for k := j; k < len(mtr.Series); k++ {
+			if other, ok := mi.series[mtr.Series[k].id(mtr.Labels)]; ok && other == k+1 {
+				mi.series[mtr.Series[k].id(mtr.Labels)] = k
+			}
 		}
 	}
-	return false
 }
 
-func loadState(file string) error {
-	if !fileExists(file) {
-		err := os.WriteFile(file, []byte(stateDefault), 0644)
-		if err != nil {
-			return fmt.Errorf("state file does not exist and could not be created")
-		}
+// Put replaces the metric with the same key or appends it if it's unknown.
+func (s *State) Put(m StateMetric) error {
+	return s.apply(Mutation{Op: MutationPut, Key: m.Key, Metric: &m})
+}
+
+// SetDescription changes the description of the metric with the given key.
+func (s *State) SetDescription(k, d string) error {
+	return s.apply(Mutation{Op: MutationDescribe, Key: k, Description: d})
+}
+
+// Remove removes the metric with the given key.
+func (s *State) Remove(k string) error {
+	return s.apply(Mutation{Op: MutationRemove, Key: k})
+}
+
+// PutSeries replaces the series with the same labels or appends it if it's unknown.
+func (s *State) PutSeries(k string, names []string, ss StateSeries) error {
+	return s.apply(Mutation{Op: MutationPutSeries, Key: k, Names: names, Series: &ss})
+}
+
+// RemoveSeries removes the series with the given label values.
+func (s *State) RemoveSeries(k string, names, values []string) error {
+	return s.apply(Mutation{Op: MutationRemoveSeries, Key: k, Names: names, Values: values})
+}
+
+// get returns a copy of the metric with the given key.
+func (s *State) get(k string) (StateMetric, bool) {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mi, ok := s.indexLocked()[k]
+	if !ok {
+		return StateMetric{}, false
 	}
+	mtr := s.Metrics[mi.pos]
+	// series are replaced rather than modified, so copying the slice is enough
+	mtr.Series = append([]StateSeries{}, mtr.Series...)
+	return mtr, true
+}
 
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return err
+// copyMetrics returns a copy of all metrics with their series.
+func (s *State) copyMetrics() []StateMetric {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	metrics := make([]StateMetric, len(s.Metrics))
+	for i, mtr := range s.Metrics {
+		// series are replaced rather than modified, so copying the slice is enough
+		mtr.Series = append([]StateSeries{}, mtr.Series...)
+		metrics[i] = mtr
 	}
+	return metrics
+}
 
-	c := &State{}
-	yaml.Unmarshal(data, c)
-	state = c
-	return nil
+// replace swaps the metrics of the state, e.g. with the ones of a snapshot.
+func (s *State) replace(metrics []StateMetric) {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Metrics = metrics
+	s.index = nil
 }
 
-func saveState(file string) error {
-	data, err := yaml.Marshal(state)
-	if err != nil {
-		return err
+// open makes the store persist all further mutations.
+func (s *State) open(store StateStore) {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.store = store
+}
+
+// save writes all metrics to the store, compacting the mutations persisted so far.
+func (s *State) save() error {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Save(s.Metrics)
+}
+
+// wait blocks until the mutations applied so far are durable, see Durability.
+func (s *State) wait() {
+	s.init()
+	s.lock.Lock()
+	store := s.store
+	s.lock.Unlock()
+	if w, ok := store.(waiter); ok {
+		w.Wait()
+	}
+}
+
+// close stops persisting mutations, e.g. after the final save.
+func (s *State) close() error {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.store == nil {
+		return nil
+	}
+	err := s.store.Close()
+	s.store = nil
+	return err
+}
+
+// loadState loads the metrics from the store. If the store is corrupt and recovery is enabled,
+// the newest snapshot of the state file that can be parsed is used instead and the mutations
+// that could still be read from the store are applied to it.
+func loadState(store StateStore, stateFile string, recovery bool) ([]StateMetric, error) {
+	metrics, err := store.Load()
+	var corrupt *CorruptStateError
+	if err == nil || !recovery || !errors.As(err, &corrupt) {
+		return metrics, err
 	}
+	c, errRecover := recoverState(stateFile)
+	if errRecover != nil {
+		return nil, fmt.Errorf("%w, %s", err, errRecover.Error())
+	}
+	for _, mut := range corrupt.Mutations {
+		c.applyLocked(mut)
+	}
+	return c.Metrics, nil
+}
 
-	return os.WriteFile(file, data, 0644)
+// recoverState returns the newest snapshot of the given state file that can be parsed.
+func recoverState(file string) (*State, error) {
+	snapshots, err := listSnapshots(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		data, err := os.ReadFile(snapshot.Path)
+		if err != nil {
+			continue
+		}
+		if metrics, err := parseYAMLState(data); err == nil {
+			return &State{Metrics: metrics}, nil
+		}
+	}
+	return nil, errors.New("no snapshot could be recovered")
 }
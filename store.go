@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// StateStore persists the state of a server. Apply is called for every change while
+// the state is locked, Save periodically with all metrics to compact the changes.
+type StateStore interface {
+	// Load returns the persisted metrics including all changes applied since the last Save.
+	Load() ([]StateMetric, error)
+	// Save replaces all persisted metrics.
+	Save(metrics []StateMetric) error
+	// Apply persists a single change of the state. The changes of a transactional batch are
+	// passed as one MutationBatch, which must be persisted atomically.
+	Apply(mut Mutation) error
+	// Close syncs pending changes and releases the resources of the store.
+	Close() error
+}
+
+// waiter is implemented by stores that acknowledge changes before they are synced to disk.
+type waiter interface {
+	Wait()
+}
+
+// StateBackend selects one of the built-in stores.
+type StateBackend string
+
+const (
+	BackendYAML      StateBackend = "yaml"  // YAML snapshot and a write-ahead log
+	BackendJSONLines StateBackend = "jsonl" // one JSON change per line, compacted on save
+	BackendBolt      StateBackend = "bolt"  // embedded bbolt key-value database
+)
+
+// newStateStore creates the built-in store of the given backend.
+// Group commits of batched durability happen every batch interval, those of interval durability every flush interval.
+func newStateStore(backend StateBackend, file string, durability Durability, batchInterval, flushInterval time.Duration) (StateStore, error) {
+	interval := batchInterval
+	if durability == DurabilityInterval {
+		interval = flushInterval
+	}
+	switch backend {
+	case "", BackendYAML:
+		return newFileStore(file, durability, interval), nil
+	case BackendJSONLines:
+		return newJSONLinesStore(file, durability, interval), nil
+	case BackendBolt:
+		return newBoltStore(file, durability, interval), nil
+	}
+	return nil, fmt.Errorf("unknown state backend %q", backend)
+}
+
+// CorruptStateError is returned by stores whose persisted state can't be parsed.
+type CorruptStateError struct {
+	File      string     // the corrupt file
+	Copy      string     // where a copy of the corrupt file was kept
+	Err       error      // the parse error
+	Mutations []Mutation // changes that could still be read, to be applied to a recovered snapshot
+}
+
+func (e *CorruptStateError) Error() string {
+	return fmt.Sprintf("state file %s is corrupt, a copy was kept at %s: %s", e.File, e.Copy, e.Err.Error())
+}
+
+func (e *CorruptStateError) Unwrap() error {
+	return e.Err
+}
+
+// keepCorrupt copies the given file to a timestamped .corrupt file next to it.
+func keepCorrupt(file string, data []byte) (string, error) {
+	corrupt := fmt.Sprintf("%s.%s.corrupt", file, time.Now().Format("20060102-150405"))
+	return corrupt, writeFileAtomic(corrupt, data, 0644)
+}
+
+// readStateFile reads the given file, creating it with the default content if it doesn't exist,
+// and parses it. If it can't be parsed, a copy of it is kept and a *CorruptStateError is returned.
+func readStateFile(file string, def []byte, parse func([]byte) ([]StateMetric, error)) ([]StateMetric, error) {
+	if !fileExists(file) {
+		err := writeFileAtomic(file, def, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("state file does not exist and could not be created")
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := parse(data)
+	if errors.Is(err, errNewerVersion) {
+		return nil, fmt.Errorf("state file %s: %w", file, err)
+	}
+	if err != nil {
+		corrupt, errKeep := keepCorrupt(file, data)
+		if errKeep != nil {
+			return nil, fmt.Errorf("state file %s is corrupt and could not be copied: %w", file, errors.Join(err, errKeep))
+		}
+		return nil, &CorruptStateError{File: file, Copy: corrupt, Err: err}
+	}
+	return metrics, nil
+}
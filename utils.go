@@ -9,10 +9,12 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,13 +24,19 @@ var (
 	reNonASCII = regexp.MustCompile(`[^a-zA-Z0-9\-\_]+`)
 )
 
+// interfaceToFloat64 converts numbers and strings of numbers to float64. NaN and infinities are rejected,
+// a series can't recover from them.
 func interfaceToFloat64(i interface{}) (float64, bool) {
 	v := float64(0)
 	switch c := i.(type) {
 	case []byte:
-		v, _ = strconv.ParseFloat(string(c), 64)
+		return interfaceToFloat64(string(c))
 	case string:
-		v, _ = strconv.ParseFloat(c, 64)
+		f, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		if err != nil {
+			return 0, false
+		}
+		v = f
 	case int:
 		v = float64(c)
 	case int8:
@@ -56,9 +64,69 @@ func interfaceToFloat64(i interface{}) (float64, bool) {
 	default:
 		return v, false
 	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
 	return v, true
 }
 
+// parseBuckets parses a comma-separated list of bucket upper bounds, e.g. "0.1,0.5,1".
+func parseBuckets(s string) ([]float64, bool) {
+	buckets := []float64{}
+	if s == "" {
+		return buckets, true
+	}
+	for _, b := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return nil, false
+		}
+		buckets = append(buckets, f)
+	}
+	return buckets, true
+}
+
+// parseObjectives parses a comma-separated list of quantile:error pairs, e.g. "0.5:0.05,0.9:0.01".
+func parseObjectives(s string) (map[float64]float64, bool) {
+	objectives := map[float64]float64{}
+	if s == "" {
+		return objectives, true
+	}
+	for _, o := range strings.Split(s, ",") {
+		q, e, ok := strings.Cut(o, ":")
+		if !ok {
+			return nil, false
+		}
+		fq, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+		if err != nil {
+			return nil, false
+		}
+		fe, err := strconv.ParseFloat(strings.TrimSpace(e), 64)
+		if err != nil {
+			return nil, false
+		}
+		objectives[fq] = fe
+	}
+	return objectives, true
+}
+
+func formatBuckets(buckets []float64) string {
+	s := make([]string, len(buckets))
+	for i, b := range buckets {
+		s[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+func formatObjectives(objectives map[float64]float64) string {
+	s := make([]string, 0, len(objectives))
+	for q, e := range objectives {
+		s = append(s, strconv.FormatFloat(q, 'g', -1, 64)+":"+strconv.FormatFloat(e, 'g', -1, 64))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
 func fileExists(path string) bool {
 	file, err := os.Open(path)
 	if err != nil {
@@ -69,6 +137,44 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
+// writeFileAtomic writes the data to a temporary file, syncs it and then renames it to the given name.
+// A crash leaves either the old or the new file behind, but never a truncated one.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	f, err := os.CreateTemp(dir, filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // fails once the file has been renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	// sync the directory so the rename itself survives a crash
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func sanitizeKey(name string) string {
 	name = strings.ToLower(name)
 	name = strings.ReplaceAll(name, "-", "_")
@@ -95,9 +201,24 @@ func generateSelfSignedCertificate(commonName, organization, keyFile, certFile s
 	if fileExists(certFile) {
 		return keyFile, certFile, errors.New("cert file already exists but key file is missing")
 	}
+	tml := x509.Certificate{
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(5, 0, 0),
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{organization},
+		},
+		BasicConstraintsValid: true,
+	}
+	return keyFile, certFile, createCertificate(&tml, nil, nil, keyFile, certFile)
+}
+
+// createCertificate generates a key and writes it and the certificate of the template to the files.
+// The certificate is signed with the key of the parent or self-signed if there is no parent.
+func createCertificate(tml, parent *x509.Certificate, parentKey any, keyFile, certFile string) error {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return keyFile, certFile, fmt.Errorf("generating private key failed: %s", err.Error())
+		return fmt.Errorf("generating private key failed: %s", err.Error())
 	}
 
 	keyBuf := new(bytes.Buffer)
@@ -107,23 +228,23 @@ func generateSelfSignedCertificate(commonName, organization, keyFile, certFile s
 	})
 
 	if err != nil {
-		return keyFile, certFile, fmt.Errorf("encoding private key failed: %s", err.Error())
+		return fmt.Errorf("encoding private key failed: %s", err.Error())
+	}
+	if err := os.WriteFile(keyFile, keyBuf.Bytes(), 0600); err != nil {
+		return err
 	}
-	_ = os.WriteFile(keyFile, keyBuf.Bytes(), 0600)
 
-	tml := x509.Certificate{
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(5, 0, 0),
-		SerialNumber: big.NewInt(time.Now().Unix()),
-		Subject: pkix.Name{
-			CommonName:   commonName,
-			Organization: []string{organization},
-		},
-		BasicConstraintsValid: true,
+	// random, so certificates created in the same second have different serial numbers
+	tml.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("generating serial number failed: %s", err.Error())
 	}
-	cert, err := x509.CreateCertificate(rand.Reader, &tml, &tml, &key.PublicKey, key)
+	if parent == nil {
+		parent, parentKey = tml, key
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tml, parent, &key.PublicKey, parentKey)
 	if err != nil {
-		return keyFile, certFile, fmt.Errorf("creating certificate failed: %s", err.Error())
+		return fmt.Errorf("creating certificate failed: %s", err.Error())
 	}
 
 	certBuf := new(bytes.Buffer)
@@ -133,10 +254,8 @@ func generateSelfSignedCertificate(commonName, organization, keyFile, certFile s
 	})
 
 	if err != nil {
-		return keyFile, certFile, fmt.Errorf("encoding certificate failed: %s", err.Error())
+		return fmt.Errorf("encoding certificate failed: %s", err.Error())
 	}
 
-	_ = os.WriteFile(certFile, certBuf.Bytes(), 0600)
-
-	return keyFile, certFile, nil
+	return os.WriteFile(certFile, certBuf.Bytes(), 0600)
 }
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterfaceToFloat64(t *testing.T) {
+	for _, tc := range []struct {
+		in   interface{}
+		want float64
+		ok   bool
+	}{
+		{"1.5", 1.5, true},
+		{" 2\n", 2, true},
+		{[]byte("-3"), -3, true},
+		{int64(4), 4, true},
+		{"", 0, false},
+		{"garbage", 0, false},
+		{"nan", 0, false},
+		{"NaN", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"-inf", 0, false},
+		{[]byte("Inf"), 0, false},
+		{math.NaN(), 0, false},
+		{math.Inf(1), 0, false},
+		{float32(math.Inf(-1)), 0, false},
+		{struct{}{}, 0, false},
+	} {
+		v, ok := interfaceToFloat64(tc.in)
+		if ok != tc.ok || (ok && v != tc.want) {
+			t.Errorf("interfaceToFloat64(%#v) = %v, %v, expected %v, %v", tc.in, v, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// maxWALRecord protects against allocating huge buffers for corrupted record lengths.
+	maxWALRecord = 64 << 20
+)
+
+// Durability defines when mutations persisted by a store are synced to disk.
+type Durability string
+
+const (
+	DurabilityInterval Durability = "interval" // synced in the background every flush interval
+	DurabilityOnWrite  Durability = "on-write" // synced before the mutation is acknowledged
+	DurabilityBatched  Durability = "batched"  // synced by a group commit every batch interval, requests wait for it
+)
+
+func parseDurability(s string) (Durability, bool) {
+	switch d := Durability(s); d {
+	case "":
+		return DurabilityOnWrite, true
+	case DurabilityInterval, DurabilityOnWrite, DurabilityBatched:
+		return d, true
+	}
+	return "", false
+}
+
+// syncer keeps track of which writes have been synced to disk. With on-write durability
+// every write is synced immediately, otherwise group commits sync them in the background.
+type syncer struct {
+	durability Durability
+	flush      func() error // syncs all writes to disk
+	lock       *sync.Mutex
+	synced     *sync.Cond
+	written    uint64 // number of writes
+	flushed    uint64 // number of writes synced to disk
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// wrote records a write. With on-write durability it's synced to disk before returning.
+func (s *syncer) wrote() error {
+	s.lock.Lock()
+	s.written++
+	s.lock.Unlock()
+	if s.durability == DurabilityOnWrite {
+		return s.sync()
+	}
+	return nil
+}
+
+// sync syncs all writes recorded so far to disk.
+func (s *syncer) sync() error {
+	s.lock.Lock()
+	target := s.written
+	s.lock.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if target > s.flushed {
+		s.flushed = target
+	}
+	s.lock.Unlock()
+	s.synced.Broadcast()
+	return nil
+}
+
+// Wait blocks until all writes recorded so far have been synced by a group commit.
+// It returns immediately unless the durability is batched.
+func (s *syncer) Wait() {
+	if s.durability != DurabilityBatched {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	target := s.written
+	for s.flushed < target {
+		select {
+		case <-s.stopped:
+			return
+		default:
+		}
+		s.synced.Wait()
+	}
+}
+
+// commit syncs the writes recorded since the last group commit every interval until the syncer is closed.
+func (s *syncer) commit(interval time.Duration) {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+			s.lock.Lock()
+			pending := s.written > s.flushed
+			s.lock.Unlock()
+			if pending {
+				_ = s.sync()
+			}
+		}
+	}
+}
+
+// close stops the group commits and syncs the remaining writes.
+func (s *syncer) close() error {
+	close(s.done)
+	<-s.stopped
+	err := s.sync()
+	// release requests still waiting for a group commit that failed
+	s.lock.Lock()
+	s.synced.Broadcast()
+	s.lock.Unlock()
+	return err
+}
+
+// newSyncer creates a syncer, interval is the time between group commits.
+func newSyncer(durability Durability, interval time.Duration, flush func() error) *syncer {
+	lock := &sync.Mutex{}
+	s := &syncer{
+		durability: durability,
+		flush:      flush,
+		lock:       lock,
+		synced:     sync.NewCond(lock),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	if durability == DurabilityOnWrite {
+		close(s.stopped)
+	} else {
+		go s.commit(interval)
+	}
+	return s
+}
+
+// wal is an append-only log of the mutations applied to the state since the last snapshot.
+// Every record is framed by its length and CRC32 checksum, so a record that was torn
+// by a crash is detected and ignored when the log is replayed.
+type wal struct {
+	file   *os.File
+	syncer *syncer
+}
+
+func walFile(stateFile string) string {
+	return stateFile + ".wal"
+}
+
+// append writes the mutation to the log. With on-write durability it's synced to disk before returning.
+func (w *wal) append(mut Mutation) error {
+	payload, err := yaml.Marshal(mut)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[8:], payload)
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	return w.syncer.wrote()
+}
+
+// truncate empties the log, e.g. after its mutations have been compacted into a snapshot.
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.syncer.sync()
+}
+
+func (w *wal) close() error {
+	return errors.Join(w.syncer.close(), w.file.Close())
+}
+
+func openWAL(path string, durability Durability, interval time.Duration) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{file: f, syncer: newSyncer(durability, interval, f.Sync)}, nil
+}
+
+// readWAL returns the mutations of the log at the given path. Reading stops
+// at the first incomplete or corrupted record, which can only be the result of
+// a crash during the write and therefore was never acknowledged.
+func readWAL(path string) ([]Mutation, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	muts := []Mutation{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return muts, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxWALRecord {
+			return muts, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return muts, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return muts, nil
+		}
+		mut := Mutation{}
+		if err := yaml.Unmarshal(payload, &mut); err != nil {
+			return muts, nil
+		}
+		muts = append(muts, mut)
+	}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeWALState persists a counter with the given values as mutations of the write-ahead log, without a save.
+func writeWALState(t *testing.T, file string, values ...float64) {
+	t.Helper()
+	fs := newFileStore(file, DurabilityOnWrite, time.Minute)
+	if _, err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s := &State{}
+	s.open(fs)
+	if err := s.Put(StateMetric{Key: "c", Type: Counter}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if err := s.PutSeries("c", nil, StateSeries{Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadCounter(t *testing.T, store StateStore) float64 {
+	t.Helper()
+	defer store.Close()
+	metrics, err := store.Load()
+	if err != nil {
+		t.Fatalf("state could not be loaded: %v", err)
+	}
+	if len(metrics) != 1 || metrics[0].Key != "c" || len(metrics[0].Series) != 1 {
+		t.Fatalf("unexpected state %+v", metrics)
+	}
+	return metrics[0].Series[0].Value
+}
+
+func TestTornWAL(t *testing.T) {
+	for name, tail := range map[string][]byte{
+		"header":   {0, 0, 0},
+		"payload":  {0, 0, 0, 100, 1, 2, 3, 4, 'o', 'p'},
+		"checksum": append([]byte{0, 0, 0, 9, 0, 0, 0, 0}, "op: put\n"...),
+		"length":   {0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0},
+	} {
+		tail := tail
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "state.yaml")
+			writeWALState(t, file, 1, 2)
+			f, err := os.OpenFile(walFile(file), os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tail); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			if v := loadCounter(t, newFileStore(file, DurabilityOnWrite, time.Minute)); v != 2 {
+				t.Errorf("counter is %v, want the value of the last complete record", v)
+			}
+		})
+	}
+}
+
+func TestWALAfterSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.yaml")
+	writeWALState(t, file, 1)
+	fs := newFileStore(file, DurabilityOnWrite, time.Minute)
+	s := &State{}
+	metrics, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.replace(metrics)
+	s.open(fs)
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutSeries("c", nil, StateSeries{Value: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// no close, the mutation after the save must be replayed on top of the snapshot
+	if v := loadCounter(t, newFileStore(file, DurabilityOnWrite, time.Minute)); v != 3 {
+		t.Errorf("counter is %v, want 3", v)
+	}
+	fs.Close()
+}